@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// one line of log.txt: "<date> <time> <send> <recv> <bytes> ..."
+type logRecord struct {
+	send  float64
+	recv  float64
+	bytes int
+}
+
+// per-second aggregate of a capture
+type secondStats struct {
+	second    int64 // unix second of the receive time
+	events    int
+	min       float64 // delays in milliseconds
+	median    float64
+	p90       float64
+	max       float64
+	bandwidth float64 // bytes/s
+}
+
+func parseLogLine(line string) (logRecord, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return logRecord{}, false
+	}
+	send, err1 := strconv.ParseFloat(fields[2], 64)
+	recv, err2 := strconv.ParseFloat(fields[3], 64)
+	bytes, err3 := strconv.Atoi(fields[4])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return logRecord{}, false
+	}
+	return logRecord{send: send, recv: recv, bytes: bytes}, true
+}
+
+func readLog(r io.Reader) ([]logRecord, error) {
+	var records []logRecord
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if rec, ok := parseLogLine(s.Text()); ok {
+			records = append(records, rec)
+		}
+	}
+	return records, s.Err()
+}
+
+// bucket records by the second they were received in, empty seconds included
+func perSecond(records []logRecord) []secondStats {
+	if len(records) == 0 {
+		return nil
+	}
+	buckets := make(map[int64]*window)
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, rec := range records {
+		second := int64(math.Floor(rec.recv))
+		w, ok := buckets[second]
+		if !ok {
+			w = &window{}
+			buckets[second] = w
+		}
+		w.add(rec.recv-rec.send, rec.bytes)
+		if second < first {
+			first = second
+		}
+		if second > last {
+			last = second
+		}
+	}
+
+	result := make([]secondStats, 0, last-first+1)
+	for second := first; second <= last; second++ {
+		row := secondStats{second: second}
+		if w, ok := buckets[second]; ok {
+			sort.Float64s(w.delays)
+			row.events = len(w.delays)
+			row.min = w.delays[0] * 1000
+			row.median = percentile(w.delays, 50) * 1000
+			row.p90 = percentile(w.delays, 90) * 1000
+			row.max = w.delays[len(w.delays)-1] * 1000
+			row.bandwidth = float64(w.bytes)
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+func writeCSV(out io.Writer, rows []secondStats) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "second,unix_time,events,min_delay_ms,median_delay_ms,p90_delay_ms,max_delay_ms,bytes_per_sec")
+	for i, row := range rows {
+		fmt.Fprintf(w, "%d,%d,%d,%.3f,%.3f,%.3f,%.3f,%.0f\n",
+			i, row.second, row.events, row.min, row.median, row.p90, row.max, row.bandwidth)
+	}
+	return w.Flush()
+}
+
+// self-contained svg with two stacked charts: delay percentiles and bandwidth
+func writeSVG(out io.Writer, rows []secondStats) error {
+	const (
+		width  = 800
+		height = 260 // per chart
+		margin = 50
+		plotW  = width - 2*margin
+		plotH  = height - 2*margin
+		totalH = 2 * height
+	)
+
+	// delays can go negative when the node clock is ahead of the logger
+	minDelay, maxDelay, maxBandwidth := 0.0, 0.0, 0.0
+	for _, row := range rows {
+		minDelay = math.Min(minDelay, row.median)
+		maxDelay = math.Max(maxDelay, row.p90)
+		maxBandwidth = math.Max(maxBandwidth, row.bandwidth)
+	}
+
+	x := func(i int) float64 {
+		if len(rows) < 2 {
+			return margin
+		}
+		return margin + float64(i)*plotW/float64(len(rows)-1)
+	}
+	y := func(top int, v float64, min float64, max float64) float64 {
+		if max == min {
+			return float64(top + margin + plotH)
+		}
+		return float64(top+margin+plotH) - (v-min)/(max-min)*plotH
+	}
+	line := func(top int, min float64, max float64, value func(secondStats) float64) string {
+		points := make([]string, len(rows))
+		for i, row := range rows {
+			points[i] = fmt.Sprintf("%.1f,%.1f", x(i), y(top, value(row), min, max))
+		}
+		return strings.Join(points, " ")
+	}
+	axes := func(w io.Writer, top int, title string, min float64, max float64, unit string) {
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-size=\"14\">%s</text>\n", margin, top+margin-20, title)
+		fmt.Fprintf(w, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"black\"/>\n", margin, top+margin, margin, top+margin+plotH)
+		fmt.Fprintf(w, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"black\"/>\n", margin, top+margin+plotH, margin+plotW, top+margin+plotH)
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-size=\"10\" text-anchor=\"end\">%.2f %s</text>\n", margin-4, top+margin+4, max, unit)
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-size=\"10\" text-anchor=\"end\">%.2f</text>\n", margin-4, top+margin+plotH, min)
+		fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\" font-size=\"10\" text-anchor=\"end\">%d s</text>\n", margin+plotW, top+margin+plotH+15, len(rows))
+	}
+
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\">\n", width, totalH)
+	fmt.Fprintf(w, "<rect width=\"%d\" height=\"%d\" fill=\"white\"/>\n", width, totalH)
+
+	axes(w, 0, "Delay per second (median blue, 90th percentile red)", minDelay, maxDelay, "ms")
+	fmt.Fprintf(w, "<polyline fill=\"none\" stroke=\"blue\" points=\"%s\"/>\n", line(0, minDelay, maxDelay, func(r secondStats) float64 { return r.median }))
+	fmt.Fprintf(w, "<polyline fill=\"none\" stroke=\"red\" points=\"%s\"/>\n", line(0, minDelay, maxDelay, func(r secondStats) float64 { return r.p90 }))
+
+	axes(w, height, "Bandwidth per second", 0, maxBandwidth, "B/s")
+	fmt.Fprintf(w, "<polyline fill=\"none\" stroke=\"green\" points=\"%s\"/>\n", line(height, 0, maxBandwidth, func(r secondStats) float64 { return r.bandwidth }))
+
+	fmt.Fprintln(w, "</svg>")
+	return w.Flush()
+}
+
+// logger analyze [-csv file] [-svg file] [log.txt]
+func analyzeCommand(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	csvPath := fs.String("csv", "-", "output csv file, - for stdout")
+	svgPath := fs.String("svg", "", "output svg chart, skipped when empty")
+	fs.Parse(args)
+
+	path := "log.txt"
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	records, err := readLog(f)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rows := perSecond(records)
+
+	if *csvPath != "" {
+		out := io.Writer(os.Stdout)
+		if *csvPath != "-" {
+			f, err := os.Create(*csvPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		if err := writeCSV(out, rows); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *svgPath != "" {
+		f, err := os.Create(*svgPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		if err := writeSVG(f, rows); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// result of one load level
+type benchStage struct {
+	offered    float64 // events/s the simulated nodes tried to send
+	ingested   float64 // events/s that made it through ingestEvent
+	delays     []float64
+	goroutines int
+	heap       uint64
+}
+
+// the stage kept up when the logger ingested nearly everything offered without queueing up
+func (b benchStage) keptUp(maxDelay time.Duration) bool {
+	return b.ingested >= 0.95*b.offered && percentile(b.delays, 90) <= seconds(maxDelay)
+}
+
+// "min[,max]" events/s per node
+func parseRateRange(spec string) (float64, float64, error) {
+	parts := strings.Split(spec, ",")
+	low, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || low <= 0 || len(parts) > 2 {
+		return 0, 0, errors.New("expected min[,max] events per second")
+	}
+	high := low
+	if len(parts) == 2 {
+		if high, err = strconv.ParseFloat(parts[1], 64); err != nil || high < low {
+			return 0, 0, errors.New("expected min[,max] events per second")
+		}
+	}
+	return low, high, nil
+}
+
+// a simulated node: Poisson events at rate * multiplier until stop is closed
+func benchNode(address string, id string, rate float64, seed int64, multiplier *uint64, sent *int64, stop chan struct{}) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, id, "cannot connect:", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := writeFrame(conn, typeConnect, []byte(timestampNow()+" - "+id+" connected")); err != nil {
+		return
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	var seq uint64
+	for {
+		scale := math.Float64frombits(atomic.LoadUint64(multiplier))
+		wait := time.Duration(random.ExpFloat64() / (rate * scale) * float64(time.Second))
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		seq++
+		hash := sha256.Sum256([]byte(id + strconv.FormatUint(seq, 10)))
+		payload := timestampNow() + " " + id + " " + strconv.FormatUint(seq, 10) + " " + hex.EncodeToString(hash[:])
+		if _, err := writeFrame(conn, typeEvent, []byte(payload)); err != nil {
+			return
+		}
+		atomic.AddInt64(sent, 1)
+	}
+}
+
+// logger bench [-nodes n] [-rate min[,max]] [-duration d] [-stages n] [-ramp x] [-max-delay d]
+// runs the accept loop in-process against simulated nodes, raising the load every stage
+func benchCommand(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	nodes := fs.Int("nodes", 200, "simulated nodes")
+	rateSpec := fs.String("rate", "5,20", "events/s per node, each node picks a rate in min[,max]")
+	duration := fs.Duration("duration", 5*time.Second, "length of each load stage")
+	stages := fs.Int("stages", 6, "number of load stages")
+	ramp := fs.Float64("ramp", 2, "rate multiplier from one stage to the next")
+	maxDelay := fs.Duration("max-delay", 50*time.Millisecond, "90th percentile delay above which a stage counts as overloaded")
+	fs.Parse(args)
+
+	low, high, err := parseRateRange(*rateSpec)
+	if err != nil {
+		log.Fatal("Invalid -rate ", err)
+	}
+
+	// the logger's own output would dominate the measurement
+	out := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() { os.Stdout = out }()
+	log.SetOutput(io.Discard)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+	go serve(listener)
+
+	multiplier := math.Float64bits(1)
+	var sent int64
+	stop := make(chan struct{})
+	offeredBase := 0.0
+	for i := 0; i < *nodes; i++ {
+		rate := low + rand.Float64()*(high-low)
+		offeredBase += rate
+		go benchNode(listener.Addr().String(), "bench"+strconv.Itoa(i+1), rate, rand.Int63(), &multiplier, &sent, stop)
+	}
+	defer close(stop)
+
+	fmt.Fprintf(out, "%d nodes, %.0f events/s at stage 1, %v per stage\n", *nodes, offeredBase, *duration)
+	fmt.Fprintln(out, "stage  offered/s  ingested/s  p50_ms   p90_ms   p99_ms   goroutines  heap_MB")
+
+	time.Sleep(500 * time.Millisecond) // let the nodes connect
+	stats.Snapshot()
+
+	best := -1.0
+	saturated := false // a stage fell behind, best is the real maximum and not a lower bound
+	scale := 1.0
+	for stage := 1; stage <= *stages; stage++ {
+		atomic.StoreUint64(&multiplier, math.Float64bits(scale))
+		before := atomic.LoadInt64(&sent)
+		stats.Snapshot()
+		time.Sleep(*duration)
+		global, _, elapsed, _ := stats.Snapshot()
+		after := atomic.LoadInt64(&sent)
+
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		result := benchStage{
+			offered:    float64(after-before) / elapsed,
+			ingested:   float64(len(global.delays)) / elapsed,
+			delays:     global.delays,
+			goroutines: runtime.NumGoroutine(),
+			heap:       mem.HeapAlloc,
+		}
+		sort.Float64s(result.delays)
+		fmt.Fprintf(out, "%5d  %9.0f  %10.0f  %7.3f  %7.3f  %7.3f  %10d  %7.1f\n",
+			stage, result.offered, result.ingested,
+			percentile(result.delays, 50)*1000,
+			percentile(result.delays, 90)*1000,
+			percentile(result.delays, 99)*1000,
+			result.goroutines, float64(result.heap)/(1<<20))
+
+		if !result.keptUp(*maxDelay) {
+			saturated = true
+			break
+		}
+		best = result.ingested
+		scale *= *ramp
+	}
+
+	switch {
+	case best < 0:
+		fmt.Fprintln(out, "the logger could not keep up even at the first stage")
+	case !saturated:
+		fmt.Fprintf(out, "max sustained ingest rate: at least %.0f events/s (not saturated, raise -stages, -ramp or -nodes)\n", best)
+	default:
+		fmt.Fprintf(out, "max sustained ingest rate: %.0f events/s\n", best)
+	}
+}
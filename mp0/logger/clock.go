@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	syncSamples    = 4                     // requests per sync round
+	syncSpacing    = 10 * time.Millisecond // gap between requests of one round
+	syncKeepRecent = 2 * syncSamples       // samples the estimate is picked from
+)
+
+// how often the clock offset of a node is measured again, 0 disables syncing
+var resyncInterval = 10 * time.Second
+
+// one Cristian round trip: the logger sent at t0, the node stamped t1, the logger got it at t2
+type clockSample struct {
+	offset time.Duration // node clock - logger clock
+	rtt    time.Duration
+}
+
+// offset estimate of one node's clock relative to the logger
+type ClockEstimate struct {
+	lock    sync.Mutex
+	samples []clockSample
+}
+
+// estimated offset and error bound, ok is false until the first reply arrives.
+// like NTP the sample with the smallest round trip of the recent ones wins
+func (c *ClockEstimate) Offset() (offset time.Duration, bound time.Duration, ok bool) {
+	if c == nil {
+		return 0, 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.samples) == 0 {
+		return 0, 0, false
+	}
+	best := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	return best.offset, best.rtt / 2, true
+}
+
+// handle a "<t0> <t1>" sync reply (nanoseconds)
+func (c *ClockEstimate) Reply(payload string, received time.Time) {
+	parts := strings.Split(payload, " ")
+	if len(parts) < 2 {
+		return
+	}
+	t0, err0 := strconv.ParseInt(parts[0], 10, 64)
+	t1, err1 := strconv.ParseInt(parts[1], 10, 64)
+	if err0 != nil || err1 != nil {
+		return
+	}
+	t2 := received.UnixNano()
+	if t2 < t0 {
+		return
+	}
+
+	sample := clockSample{
+		offset: time.Duration(t1 - (t0+t2)/2),
+		rtt:    time.Duration(t2 - t0),
+	}
+	c.lock.Lock()
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > syncKeepRecent {
+		c.samples = c.samples[len(c.samples)-syncKeepRecent:]
+	}
+	c.lock.Unlock()
+}
+
+func (c *ClockEstimate) String() string {
+	offset, bound, ok := c.Offset()
+	if !ok {
+		return "clock offset unknown"
+	}
+	return fmt.Sprintf("clock offset %.3fms ± %.3fms", seconds(offset)*1000, seconds(bound)*1000)
+}
+
+// send sync rounds to a node until done is closed, the replies come back through handleConnection
+func syncClock(conn io.Writer, done chan struct{}) {
+	if resyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		for i := 0; i < syncSamples; i++ {
+			payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+			if _, err := writeFrame(conn, typeSyncRequest, []byte(payload)); err != nil {
+				return
+			}
+			time.Sleep(syncSpacing)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// the node side of syncClock for connections this logger dials itself: stamp every sync
+// request with our clock and send it back through write, until reading from conn fails
+func answerSync(conn io.Reader, write func(frameType byte, payload []byte) error) {
+	r := bufio.NewReader(conn)
+	for {
+		frame, _, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if frame.Type == typeSyncRequest {
+			now := strconv.FormatInt(time.Now().UnixNano(), 10)
+			write(typeSyncReply, []byte(string(frame.Payload)+" "+now))
+		}
+	}
+}
+
+func seconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
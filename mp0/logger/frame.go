@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// wire format between node and logger (keep in sync with the copy in the other module)
+//
+//	+----------------+---------+------+---------+
+//	| length (4, BE) | version | type | payload |
+//	+----------------+---------+------+---------+
+//
+// length counts the bytes after the length field (version + type + payload)
+
+const (
+	frameVersion   = 1
+	frameLenSize   = 4
+	frameHeaderLen = frameLenSize + 2
+	maxFrameLen    = 1 << 20
+)
+
+// frame types
+const (
+	typeConnect byte = 1 // "<ts> - <node> connected"
+	typeEvent   byte = 2 // "<ts> <node> <seq> <hash>"
+	typeDelayed byte = 3 // same payload as typeEvent, buffered by the node while disconnected
+
+	// clock sync, logger -> node "<logger ns>", node -> logger "<logger ns> <node ns>"
+	typeSyncRequest byte = 4
+	typeSyncReply   byte = 5
+
+	// first frame of a subscriber connection, "<node>,<node>..." or empty for all nodes.
+	// the logger then streams typeEvent frames "<recv ts> <event payload>"
+	typeSubscribe byte = 6
+
+	// logger -> parent logger, "<logger>@<recv ts>[,<logger>@<recv ts>...] <event payload>"
+	typeForward byte = 7
+
+	// node -> logger, a codec byte followed by typeEvent / typeDelayed frames
+	// concatenated and compressed with that codec
+	typeBatch byte = 8
+)
+
+// batch codecs
+const (
+	codecNone  byte = 0
+	codecGzip  byte = 1
+	codecFlate byte = 2
+)
+
+// unpacked batches larger than this are rejected
+const maxBatchLen = 16 * maxFrameLen
+
+var (
+	errFrameTooLarge = errors.New("frame too large")
+	errFrameVersion  = errors.New("unsupported frame version")
+	errBatchCodec    = errors.New("unknown batch codec")
+)
+
+type Frame struct {
+	Version byte
+	Type    byte
+	Payload []byte
+}
+
+// encode a frame into a single buffer so it goes out in one write
+func encodeFrame(frameType byte, payload []byte) []byte {
+	buf := make([]byte, frameHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(2+len(payload)))
+	buf[frameLenSize] = frameVersion
+	buf[frameLenSize+1] = frameType
+	copy(buf[frameHeaderLen:], payload)
+	return buf
+}
+
+// write one frame, returns the number of bytes put on the wire
+func writeFrame(w io.Writer, frameType byte, payload []byte) (int, error) {
+	return w.Write(encodeFrame(frameType, payload))
+}
+
+// pack frames into a typeBatch payload
+func encodeBatch(codec byte, frames []Frame) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(codec)
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case codecNone:
+		w = nopCloser{&buf}
+	case codecGzip:
+		w = gzip.NewWriter(&buf)
+	case codecFlate:
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		err = errBatchCodec
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range frames {
+		if _, err := writeFrame(w, f.Type, f.Payload); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unpack a typeBatch payload, sizes are the uncompressed frame sizes
+func decodeBatch(payload []byte) (frames []Frame, sizes []int, err error) {
+	if len(payload) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	var r io.Reader = bytes.NewReader(payload[1:])
+	switch payload[0] {
+	case codecNone:
+	case codecGzip:
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, nil, err
+		}
+	case codecFlate:
+		r = flate.NewReader(r)
+	default:
+		return nil, nil, errBatchCodec
+	}
+	r = bufio.NewReader(io.LimitReader(r, maxBatchLen))
+	for {
+		f, n, err := readFrame(r)
+		if err == io.EOF {
+			return frames, sizes, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		frames = append(frames, f)
+		sizes = append(sizes, n)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// read exactly one frame, returns the frame and its size on the wire
+func readFrame(r io.Reader) (Frame, int, error) {
+	var header [frameLenSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 2 {
+		return Frame{}, 0, io.ErrUnexpectedEOF
+	}
+	if length > maxFrameLen {
+		return Frame{}, 0, errFrameTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, 0, err
+	}
+	if body[0] != frameVersion {
+		return Frame{}, 0, errFrameVersion
+	}
+	return Frame{Version: body[0], Type: body[1], Payload: body[2:]}, frameLenSize + int(length), nil
+}
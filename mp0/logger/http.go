@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http posts are not connections, a node that has not posted for this long is detached
+const httpIdleTimeout = 30 * time.Second
+
+// longest event line accepted in a post
+const maxHTTPLine = 64 << 10
+
+// nodes that deliver over http, they show up in the registry like any other node
+type httpNodes struct {
+	lock     sync.Mutex
+	nodes    map[string]*NodeInfo
+	lastSeen map[string]time.Time
+	accepted int
+	rejected int
+}
+
+var httpIngest = httpNodes{
+	nodes:    make(map[string]*NodeInfo),
+	lastSeen: make(map[string]time.Time),
+}
+
+// note that id just posted, joins the registry on its first post
+func (h *httpNodes) touch(id string, address string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.nodes[id]; !ok {
+		h.nodes[id] = registry.Join(id, address)
+		fmt.Println(timestampNow() + " - " + id + " connected over http")
+		fmt.Println("Attached nodes:", strings.Join(registry.Ids(), " "))
+	}
+	h.lastSeen[id] = time.Now()
+}
+
+func (h *httpNodes) expire() {
+	for range time.Tick(httpIdleTimeout / 3) {
+		h.lock.Lock()
+		for id, seen := range h.lastSeen {
+			if time.Since(seen) < httpIdleTimeout {
+				continue
+			}
+			registry.Leave(h.nodes[id])
+			delete(h.nodes, id)
+			delete(h.lastSeen, id)
+			fmt.Println(timestampNow() + " - " + id + " disconnected (idle)")
+			fmt.Println(id+" summary:", registry.Sequence(id).Stats())
+			fmt.Println("Attached nodes:", strings.Join(registry.Ids(), " "))
+		}
+		h.lock.Unlock()
+	}
+}
+
+// POST /events with one "<ts> <node> <seq> <hash>" event per line, a single event is a one line batch
+func (h *httpNodes) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "events must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// with mutual tls the certificate says who the node is, not the payload
+	identity := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		identity = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	accepted, rejected := 0, 0
+	s := bufio.NewScanner(r.Body)
+	s.Buffer(make([]byte, 4096), maxHTTPLine)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) < 4 {
+			rejected++
+			continue
+		}
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+			rejected++
+			continue
+		}
+
+		ev := newEvent(line, time.Now(), len(line)+1)
+		if identity != "" && ev.Node != identity {
+			ev.SetNode(identity)
+		}
+		h.touch(ev.Node, r.RemoteAddr)
+		ingestEvent(ev)
+		accepted++
+	}
+	if err := s.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.lock.Lock()
+	h.accepted += accepted
+	h.rejected += rejected
+	h.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"accepted": accepted, "rejected": rejected})
+}
+
+type nodeStatus struct {
+	Id         string  `json:"id"`
+	Address    string  `json:"address,omitempty"`
+	Connected  float64 `json:"connected,omitempty"` // unix seconds, omitted once the node left
+	Received   int     `json:"received"`
+	Lost       int     `json:"lost"`
+	Duplicates int     `json:"duplicates"`
+	Reordered  int     `json:"reordered"`
+}
+
+type loggerStatus struct {
+	Logger       string       `json:"logger"`
+	Uptime       float64      `json:"uptime"`
+	Attached     int          `json:"attached"`
+	Nodes        []nodeStatus `json:"nodes"` // every node seen since the start
+	HTTPAccepted int          `json:"http_accepted"`
+	HTTPRejected int          `json:"http_rejected"`
+}
+
+// GET /status: attached nodes and their counters as json
+func (h *httpNodes) serveStatus(started time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		attached := make(map[string]NodeInfo)
+		for _, info := range registry.List() {
+			attached[info.Id] = info
+		}
+
+		status := loggerStatus{
+			Logger:   loggerId,
+			Uptime:   time.Since(started).Seconds(),
+			Attached: len(attached),
+			Nodes:    []nodeStatus{},
+		}
+		for _, id := range registry.SequenceIds() {
+			seq := registry.Sequence(id).Stats()
+			node := nodeStatus{Id: id, Received: seq.Received, Lost: seq.Lost, Duplicates: seq.Duplicates, Reordered: seq.Reordered}
+			if info, ok := attached[id]; ok {
+				node.Address = info.Address
+				node.Connected = float64(info.Connected.UnixNano()) / float64(1000000000)
+				delete(attached, id)
+			}
+			status.Nodes = append(status.Nodes, node)
+		}
+		// attached but nothing sent yet
+		for _, info := range attached {
+			status.Nodes = append(status.Nodes, nodeStatus{Id: info.Id, Address: info.Address, Connected: float64(info.Connected.UnixNano()) / float64(1000000000)})
+		}
+
+		h.lock.Lock()
+		status.HTTPAccepted = h.accepted
+		status.HTTPRejected = h.rejected
+		h.lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+	}
+}
+
+// http server for producers that cannot speak the frame protocol
+func newHTTPServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", httpIngest.serveEvents)
+	mux.HandleFunc("/status", httpIngest.serveStatus(time.Now()))
+	return &http.Server{Addr: address, Handler: mux}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a logger an event passed through on its way here
+type Hop struct {
+	Logger   string
+	Received float64 // unix seconds on that logger's clock
+}
+
+// an event as the logger ingests it, whichever way it arrived
+type Event struct {
+	Payload  string // "<ts> <node> <seq> <hash>"
+	Node     string
+	Received time.Time
+	Bytes    int            // size on the wire
+	Delayed  bool           // buffered by the node while it was disconnected
+	Clock    *ClockEstimate // clock of the sending node, nil when unknown
+	Hops     []Hop          // child loggers, nearest to the node first
+	Batch    int            // events that arrived in the same batch frame, 0 when sent alone
+}
+
+// build an event from a node's payload, the node id is taken from the payload
+func newEvent(payload string, received time.Time, bytes int) *Event {
+	ev := &Event{Payload: payload, Node: "-", Received: received, Bytes: bytes}
+	if fields := strings.Split(payload, " "); len(fields) > 1 {
+		ev.Node = fields[1]
+	}
+	return ev
+}
+
+// the events of a typeBatch frame. they all arrived at the same time and
+// share the batch's wire size in proportion to their unpacked size
+func unpackBatch(payload []byte, received time.Time, wire int) ([]*Event, error) {
+	frames, sizes, err := decodeBatch(payload)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	events := make([]*Event, 0, len(frames))
+	left := wire
+	for i, f := range frames {
+		if f.Type != typeEvent && f.Type != typeDelayed {
+			return nil, fmt.Errorf("frame type %d in batch", f.Type)
+		}
+		share := wire * sizes[i] / total
+		if i == len(frames)-1 {
+			share = left
+		}
+		left -= share
+		ev := newEvent(string(f.Payload), received, share)
+		ev.Delayed = f.Type == typeDelayed
+		ev.Batch = len(frames)
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// account the event to another node id, rewriting the payload to match
+func (ev *Event) SetNode(id string) {
+	ev.Node = id
+	if fields := strings.Split(ev.Payload, " "); len(fields) > 1 {
+		fields[1] = id
+		ev.Payload = strings.Join(fields, " ")
+	}
+}
+
+// "loggerA@<ts>,loggerB@<ts>"
+func formatHops(hops []Hop) string {
+	parts := make([]string, len(hops))
+	for i, hop := range hops {
+		parts[i] = hop.Logger + "@" + formatSeconds(hop.Received)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseHops(s string) ([]Hop, error) {
+	var hops []Hop
+	for _, part := range strings.Split(s, ",") {
+		at := strings.LastIndex(part, "@")
+		if at < 0 {
+			return nil, fmt.Errorf("malformed hop %q", part)
+		}
+		received, err := strconv.ParseFloat(part[at+1:], 64)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, Hop{Logger: part[:at], Received: received})
+	}
+	return hops, nil
+}
+
+// delay of every leg: node -> first logger -> ... -> this logger
+// "hops=loggerA:<s>,loggerB:<s>,<this logger>:<s>"
+func hopDelays(sent float64, hops []Hop, received float64) string {
+	parts := make([]string, 0, len(hops)+1)
+	previous := sent
+	for _, hop := range hops {
+		parts = append(parts, hop.Logger+":"+formatSeconds(hop.Received-previous))
+		previous = hop.Received
+	}
+	parts = append(parts, loggerId+":"+formatSeconds(received-previous))
+	return "hops=" + strings.Join(parts, ",")
+}
+
+// everything the logger does with an event: sequence checks, log line,
+// statistics, subscribers, the parent logger and stdout
+func ingestEvent(ev *Event) {
+	timestamp := strings.Split(ev.Payload, " ")
+	current := formatTimestamp(ev.Received)
+
+	if len(timestamp) > 3 {
+		seq, err := strconv.ParseUint(timestamp[2], 10, 64)
+		if err == nil {
+			if report := registry.Sequence(ev.Node).Observe(seq); report != "" {
+				fmt.Println(ev.Node + " " + report)
+			}
+		}
+	}
+
+	// over the ingest limit: dropped here, or held back so the sender slows down
+	if !limiter.Admit(ev.Node) {
+		return
+	}
+
+	// format of output: send time + receive time + bandwidth + raw delay +
+	// offset-corrected delay + error bound ("-" until the clock is synced) + node
+	// (+ "delayed" for events the node buffered while it was disconnected)
+	// (+ "batch=<n>" for events that shared a compressed batch frame, bytes is their share of it)
+	// (+ per-hop delays for events forwarded by child loggers)
+	line := timestamp[0] + " " + current + " " + strconv.Itoa(ev.Bytes)
+	sent, err := strconv.ParseFloat(timestamp[0], 64)
+	if err == nil {
+		received := float64(ev.Received.UnixNano()) / float64(1000000000)
+		delay := received - sent
+		line += " " + formatSeconds(delay)
+		if offset, bound, ok := ev.Clock.Offset(); ok {
+			line += " " + formatSeconds(delay+seconds(offset)) + " " + formatSeconds(seconds(bound))
+		} else {
+			line += " - -"
+		}
+		stats.Record(ev.Node, delay, ev.Bytes)
+	} else {
+		line += " - - -"
+	}
+	line += " " + ev.Node
+	if ev.Delayed {
+		line += " delayed"
+	}
+	if ev.Batch > 0 {
+		line += " batch=" + strconv.Itoa(ev.Batch)
+	}
+	if len(ev.Hops) > 0 && err == nil {
+		line += " " + hopDelays(sent, ev.Hops, float64(ev.Received.UnixNano())/float64(1000000000))
+	}
+	writeLogLine(ev.Node, ev.Received, line) // output -> log.txt or the current segment
+
+	subscribers.Publish(ev.Node, current+" "+ev.Payload)
+	if upstream != nil {
+		upstream.Forward(ev)
+	}
+
+	message := ev.Payload
+	if ev.Delayed {
+		message += " (delayed)"
+	}
+	if len(ev.Hops) > 0 {
+		message += " (via " + formatHops(ev.Hops) + ")"
+	}
+	fmt.Println(message)
+}
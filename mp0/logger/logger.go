@@ -1,34 +1,152 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// time in seconds, same format the nodes use for their timestamps
+func formatTimestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(1000000000), 'f', 9, 64)
+}
+
+func timestampNow() string {
+	return formatTimestamp(time.Now())
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 9, 64)
+}
+
 func handleConnection(conn net.Conn) {
-	defer conn.Close()
+	var node *NodeInfo
+	clock := &ClockEstimate{}
+	done := make(chan struct{}) // stops the clock sync rounds
+	connections.Add(conn)
+	defer connections.Done(conn)
+	defer func() {
+		close(done)
+		conn.Close()
+		if node != nil {
+			registry.Leave(node)
+			fmt.Println(timestampNow() + " - " + node.Id + " disconnected")
+			fmt.Println(node.Id+" summary:", registry.Sequence(node.Id).Stats(), "|", clock)
+			fmt.Println("Attached nodes:", strings.Join(registry.Ids(), " "))
+		}
+	}()
 
-	for {
-		var buf = make([]byte, 1024)
+	// with mutual tls the certificate says who the node is, not its connect message
+	identity, err := peerIdentity(conn)
+	if err != nil {
+		fmt.Println("TLS handshake with", conn.RemoteAddr(), "failed:", err)
+		return
+	}
 
-		n, err := conn.Read(buf) // n is the byte read from connection
+	r := bufio.NewReader(conn)
+	for {
+		frame, n, err := readFrame(r) // n is the size of the frame on the wire
 		if err != nil {
-			log.Fatal("Error! ", err)
+			// only this connection is dropped, the other nodes keep streaming
+			if err != io.EOF {
+				fmt.Println("Connection from", conn.RemoteAddr(), "closed:", err)
+			}
+			return
 		}
 
-		message := string(buf[:n])
-		timestamp := strings.Split(message, " ")
-		current := strconv.FormatFloat(float64(time.Now().UnixNano())/float64(1000000000), 'f', 9, 64)
-
-		// format of output: send time + receive time + bandwidth
-		log.Println(timestamp[0] + " " + current + " " + strconv.Itoa(n)) // output -> log.txt
+		message := string(frame.Payload)
+		switch frame.Type {
+		case typeConnect:
+			// "<ts> - <node> connected"
+			parts := strings.Split(message, " ")
+			if node == nil && len(parts) > 2 {
+				if identity != "" && parts[2] != identity {
+					fmt.Println(conn.RemoteAddr(), "claims to be", parts[2], "but its certificate is for", identity)
+					parts[2] = identity
+					message = strings.Join(parts, " ")
+				}
+				node = registry.Join(parts[2], conn.RemoteAddr().String())
+				go syncClock(conn, done)
+			}
+		case typeSyncReply:
+			clock.Reply(message, time.Now())
+			continue
+		case typeSubscribe:
+			if node == nil {
+				serveSubscriber(conn, r, message)
+				return
+			}
+		case typeEvent, typeDelayed:
+			ev := newEvent(message, time.Now(), n)
+			ev.Delayed = frame.Type == typeDelayed
+			ev.Clock = clock
+			if identity != "" && ev.Node != identity {
+				// never account events to a node other than the authenticated one
+				ev.SetNode(identity)
+			}
+			ingestEvent(ev)
+			continue
+		case typeBatch:
+			events, err := unpackBatch(frame.Payload, time.Now(), n)
+			if err != nil {
+				fmt.Println("Malformed batch from", conn.RemoteAddr(), err)
+				continue
+			}
+			for _, ev := range events {
+				ev.Clock = clock
+				if identity != "" && ev.Node != identity {
+					ev.SetNode(identity)
+				}
+				ingestEvent(ev)
+			}
+			continue
+		case typeForward:
+			// "<hops> <event payload>" from a child logger
+			name := identity
+			if name == "" && node != nil {
+				name = node.Id
+			}
+			if !isChildLogger(name, identity != "") {
+				// forwarded events name their node freely, a node must not be able to speak for others
+				fmt.Println("Refused forwarded events from", conn.RemoteAddr(), name+": not a child logger")
+				return
+			}
+			received := time.Now()
+			parts := strings.SplitN(message, " ", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			hops, err := parseHops(parts[0])
+			if err != nil {
+				fmt.Println("Malformed forwarded event from", conn.RemoteAddr(), err)
+				continue
+			}
+			if identity != "" {
+				// the last hop is the child logger itself
+				hops[len(hops)-1].Logger = identity
+			}
+			ev := newEvent(parts[1], received, n)
+			ev.Hops = hops
+			ingestEvent(ev)
+			continue
+		}
 
 		fmt.Println(message)
+		if frame.Type == typeConnect {
+			fmt.Println("Attached nodes:", strings.Join(registry.Ids(), " "))
+		}
 	}
 }
 
@@ -41,10 +159,8 @@ func deleteFile(path string){
 
 func logFileInit(path string){
 	_, err := os.Stat(path)
-	if err != nil{
-		if os.IsExist(err){
-			deleteFile(path)
-		}
+	if err == nil {
+		deleteFile(path)
 	}
 }
 
@@ -53,40 +169,231 @@ func logOutputInit(path string){
 	if err != nil {
 		return
 	}
-	defer f.Close()
+	// f stays open for the lifetime of the logger
+	logFile = f
 	log.SetOutput(f)
 }
 
+func writeLogLine(node string, received time.Time, line string) {
+	if storage != nil {
+		storage.Append(node, received, line)
+		return
+	}
+	log.Println(line)
+}
+
 func main() {
-	port := ":8080"
+	// subcommands, everything else is the logger itself
 	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			analyzeCommand(os.Args[2:])
+			return
+		case "tail":
+			tailCommand(os.Args[2:])
+			return
+		case "query":
+			queryCommand(os.Args[2:])
+			return
+		case "gencert":
+			gencertCommand(os.Args[2:])
+			return
+		case "bench":
+			benchCommand(os.Args[2:])
+			return
+		case "replay":
+			replayCommand(os.Args[2:])
+			return
+		}
+	}
+
+	statsPath := flag.String("stats", "stats.txt", "file for the one-second delay/bandwidth summary, - for stdout")
+	flag.DurationVar(&resyncInterval, "resync", resyncInterval, "interval between clock sync rounds with each node, 0 to disable")
+	segmentDir := flag.String("segments", "", "write events to rotating segment files in this directory instead of log.txt")
+	segmentSize := flag.Int64("segment-size", 64<<20, "rotate a segment after this many bytes, 0 for no limit")
+	segmentAge := flag.Duration("segment-age", time.Hour, "rotate a segment after this long, 0 for no limit")
+	retainCount := flag.Int("retain-segments", 0, "number of segments to keep, 0 for no limit")
+	retainAge := flag.Duration("retain-age", 0, "drop segments whose last event is older than this, 0 for no limit")
+	tlsCert := flag.String("tls-cert", "", "logger certificate, enables tls")
+	tlsKey := flag.String("tls-key", "", "logger private key")
+	tlsCA := flag.String("tls-ca", "", "ca that signs node certificates, requires every node to present one")
+	flag.StringVar(&loggerId, "id", "", "name of this logger in forwarded events (default hostname:port)")
+	upstreamAddress := flag.String("upstream", "", "parent logger host:port to forward every ingested event to")
+	upstreamCA := flag.String("upstream-tls-ca", "", "ca of the parent logger certificate, enables tls upstream")
+	upstreamCert := flag.String("upstream-tls-cert", "", "certificate of this logger towards the parent")
+	upstreamKey := flag.String("upstream-tls-key", "", "private key of this logger towards the parent")
+	childList := flag.String("child-loggers", "", "comma separated names (certificate CNs with -tls-ca) of the child loggers allowed to forward events")
+	transport := flag.String("transport", "tcp", "tcp, or udp with one datagram per event")
+	httpAddress := flag.String("http", "", "also accept events posted to http://<addr>/events, status at /status")
+	flag.Float64Var(&limiter.nodeRate, "node-rate", 0, "events/s each node may ingest, 0 for no limit")
+	flag.Float64Var(&limiter.globalRate, "global-rate", 0, "events/s over all nodes, 0 for no limit")
+	flag.Float64Var(&limiter.burst, "burst", limiter.burst, "seconds worth of events a node may send above its rate at once")
+	flag.StringVar(&limiter.mode, "over-limit", limiter.mode, "what happens to events over the limit: delay (tcp backpressure, tcp only) or drop (default with udp)")
+	flag.DurationVar(&drainTimeout, "drain", drainTimeout, "time open connections get to deliver after SIGINT/SIGTERM")
+	flag.Parse()
+
+	if limiter.mode != overLimitDelay && limiter.mode != overLimitDrop {
+		log.Fatal("Unknown -over-limit ", limiter.mode)
+	}
+	if limiter.burst <= 0 {
+		log.Fatal("-burst must be positive")
+	}
+
+	for _, name := range strings.Split(*childList, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			childLoggers[name] = true
+		}
+	}
+
+	port := ":8080"
+	if flag.NArg() > 0 {
 		port = ":" +
-			os.Args[1]
+			flag.Arg(0)
 	} else {
 		log.Fatal("Please enter the port number listening to in the command line")
 	}
 
 	// listen to port
-	listener, err := net.Listen("tcp", port)
-	if err != nil {
-		log.Fatal("Error! ", err)
+	var listener net.Listener
+	var packetConn net.PacketConn
+	var tlsConfig *tls.Config
+	var err error
+	if *tlsCert != "" {
+		if tlsConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatal("Error! ", err)
+		}
+	}
+	switch *transport {
+	case "tcp":
+		listener, err = net.Listen("tcp", port)
+		if err != nil {
+			log.Fatal("Error! ", err)
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		defer listener.Close()
+	case "udp":
+		if *tlsCert != "" {
+			log.Fatal("TLS is only available with the tcp transport")
+		}
+		// every node shares the one datagram reader, holding it would stall all of them
+		// and the kernel drops what does not fit anyway
+		explicitMode := false
+		flag.Visit(func(f *flag.Flag) {
+			explicitMode = explicitMode || f.Name == "over-limit"
+		})
+		if limiter.mode == overLimitDelay && explicitMode {
+			log.Fatal("-over-limit delay is only available with the tcp transport")
+		}
+		limiter.mode = overLimitDrop
+		packetConn, err = net.ListenPacket("udp", port)
+		if err != nil {
+			log.Fatal("Error! ", err)
+		}
+		defer packetConn.Close()
+	default:
+		log.Fatal("Unknown transport ", *transport)
 	}
-	defer listener.Close()
 
-	logFileInit("log.txt")
-	logOutputInit("log.txt")
+	if *segmentDir != "" {
+		storage, err = OpenStorage(*segmentDir, *segmentSize, *segmentAge, *retainCount, *retainAge)
+		if err != nil {
+			log.Fatal("Error! ", err)
+		}
+	} else {
+		logFileInit("log.txt")
+		logOutputInit("log.txt")
+	}
 	
 	fmt.Println("Listen to " + port + " port Success")
 
+	if loggerId == "" {
+		hostname, _ := os.Hostname()
+		loggerId = hostname + port
+	}
+	if *upstreamAddress != "" {
+		var config *tls.Config
+		if *upstreamCA != "" {
+			if config, err = clientTLSConfig(*upstreamCA, *upstreamCert, *upstreamKey); err != nil {
+				log.Fatal("Error! ", err)
+			}
+		}
+		upstream = NewUpstream(*upstreamAddress, 10000, config)
+	}
+
+	if *statsPath != "" {
+		go reportStats(*statsPath)
+	}
+
+	var httpServer *http.Server
+	if *httpAddress != "" {
+		httpServer = newHTTPServer(*httpAddress)
+		httpServer.TLSConfig = tlsConfig
+		go httpIngest.expire()
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = httpServer.ListenAndServeTLS("", "")
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal("Error! ", err)
+			}
+		}()
+		fmt.Println("HTTP ingest on " + *httpAddress)
+	}
+
+	// stop accepting on SIGINT/SIGTERM, a second signal exits right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopping := make(chan struct{})
+	go func() {
+		sig := <-signals
+		fmt.Println("Received", sig, "- shutting down")
+		close(stopping)
+		if packetConn != nil {
+			// keep reading what is already on its way
+			packetConn.SetReadDeadline(time.Now().Add(drainTimeout))
+		} else {
+			listener.Close()
+		}
+		<-signals
+		os.Exit(1)
+	}()
+
 	// wait for connection
+	if packetConn != nil {
+		err = serveUDP(packetConn)
+	} else {
+		err = serve(listener)
+	}
+	select {
+	case <-stopping:
+	default:
+		log.Fatal("Error", err)
+	}
+	if httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		httpServer.Shutdown(ctx)
+		cancel()
+	}
+	if listener != nil {
+		connections.Drain(drainTimeout)
+	}
+	finishLogger()
+}
+
+// accept nodes until the listener fails
+func serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 
 		if err != nil {
-			log.Fatal("Error", err)
+			return err
 		}
 
 		go handleConnection(conn)
 	}
-
 }
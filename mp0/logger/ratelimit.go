@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// what happens to an event over the limit
+const (
+	overLimitDelay = "delay" // hold the connection's reader, tcp backpressure slows the sender down. tcp only
+	overLimitDrop  = "drop"  // ingest nothing and count it, always used with udp
+)
+
+// token bucket refilled at rate events/s up to burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// how long until one more token is available, taking it either way
+func (b *bucket) take(rate float64, burst float64, now time.Time) time.Duration {
+	if burst < 1 {
+		burst = 1 // room for at least one event, or a slow rate would never admit any
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// give a token back that was taken for an event that is dropped after all
+func (b *bucket) refund() {
+	b.tokens++
+}
+
+// over-limit bookkeeping of one node since the start
+type limitCounts struct {
+	dropped int
+	delayed int
+	waited  time.Duration
+}
+
+// per-node and global ingest limits, a zero rate means unlimited
+type RateLimiter struct {
+	lock       sync.Mutex
+	nodeRate   float64
+	globalRate float64
+	burst      float64 // seconds worth of events a bucket can save up
+	mode       string
+	global     bucket
+	nodes      map[string]*bucket
+	counts     map[string]*limitCounts
+}
+
+var limiter = RateLimiter{
+	burst:  1,
+	mode:   overLimitDelay,
+	nodes:  make(map[string]*bucket),
+	counts: make(map[string]*limitCounts),
+}
+
+func (l *RateLimiter) Enabled() bool {
+	return l.nodeRate > 0 || l.globalRate > 0
+}
+
+// account one event of node, waits out the limit in delay mode, returns false if the event is to be dropped
+func (l *RateLimiter) Admit(node string) bool {
+	if !l.Enabled() {
+		return true
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	var wait, nodeWait time.Duration
+	b := l.nodes[node]
+	if l.nodeRate > 0 {
+		if b == nil {
+			b = &bucket{tokens: l.nodeRate * l.burst, last: now}
+			l.nodes[node] = b
+		}
+		nodeWait = b.take(l.nodeRate, l.nodeRate*l.burst, now)
+		wait = nodeWait
+	}
+	if l.globalRate > 0 {
+		if l.global.last.IsZero() {
+			l.global = bucket{tokens: l.globalRate * l.burst, last: now}
+		}
+		globalWait := l.global.take(l.globalRate, l.globalRate*l.burst, now)
+		if globalWait > wait {
+			wait = globalWait
+		}
+	}
+
+	c := l.counts[node]
+	if c == nil {
+		c = &limitCounts{}
+		l.counts[node] = c
+	}
+	if wait == 0 {
+		l.lock.Unlock()
+		return true
+	}
+	if l.mode == overLimitDrop {
+		// the event never happened as far as the buckets are concerned
+		if l.nodeRate > 0 {
+			b.refund()
+		}
+		if l.globalRate > 0 {
+			l.global.refund()
+		}
+		c.dropped++
+		l.lock.Unlock()
+		return false
+	}
+	c.delayed++
+	c.waited += wait
+	l.lock.Unlock()
+
+	time.Sleep(wait)
+	return true
+}
+
+// "limit dropped D, delayed W (waited Xms)" for one node, "" while no limit is set
+func (l *RateLimiter) Report(node string) string {
+	if !l.Enabled() {
+		return ""
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	c := l.counts[node]
+	if c == nil {
+		c = &limitCounts{}
+	}
+	return fmt.Sprintf("limit dropped %d, delayed %d (waited %.3fms)", c.dropped, c.delayed, seconds(c.waited)*1000)
+}
+
+// totals over all nodes and the configured limits
+func (l *RateLimiter) Summary() string {
+	if !l.Enabled() {
+		return ""
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var total limitCounts
+	for _, c := range l.counts {
+		total.dropped += c.dropped
+		total.delayed += c.delayed
+		total.waited += c.waited
+	}
+	return fmt.Sprintf("limit node=%g/s global=%g/s %s: dropped %d, delayed %d (waited %.3fms)",
+		l.nodeRate, l.globalRate, l.mode, total.dropped, total.delayed, seconds(total.waited)*1000)
+}
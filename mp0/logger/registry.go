@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// a node currently attached to the logger
+type NodeInfo struct {
+	Id        string
+	Address   string
+	Connected time.Time
+}
+
+// live registry of attached nodes, keyed by node id
+type Registry struct {
+	lock      sync.RWMutex
+	nodes     map[string]*NodeInfo
+	sequences map[string]*SeqTracker // kept across reconnects so losses at a reconnect show up
+}
+
+var registry = Registry{
+	nodes:     make(map[string]*NodeInfo),
+	sequences: make(map[string]*SeqTracker),
+}
+
+// record a node that has just sent its connect message
+func (r *Registry) Join(id string, address string) *NodeInfo {
+	info := &NodeInfo{Id: id, Address: address, Connected: time.Now()}
+	r.lock.Lock()
+	r.nodes[id] = info
+	r.lock.Unlock()
+	return info
+}
+
+// remove a node, unless the id has been taken over by a newer connection
+func (r *Registry) Leave(info *NodeInfo) {
+	r.lock.Lock()
+	if r.nodes[info.Id] == info {
+		delete(r.nodes, info.Id)
+	}
+	r.lock.Unlock()
+}
+
+// snapshot of the attached nodes sorted by id
+func (r *Registry) List() []NodeInfo {
+	r.lock.RLock()
+	nodes := make([]NodeInfo, 0, len(r.nodes))
+	for _, info := range r.nodes {
+		nodes = append(nodes, *info)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+// sequence tracker of a node, created on first use
+func (r *Registry) Sequence(id string) *SeqTracker {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	t, ok := r.sequences[id]
+	if !ok {
+		t = NewSeqTracker()
+		r.sequences[id] = t
+	}
+	return t
+}
+
+// every node that sent an event since the start, sorted
+func (r *Registry) SequenceIds() []string {
+	r.lock.RLock()
+	ids := make([]string, 0, len(r.sequences))
+	for id := range r.sequences {
+		ids = append(ids, id)
+	}
+	r.lock.RUnlock()
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *Registry) Ids() []string {
+	nodes := r.List()
+	ids := make([]string, len(nodes))
+	for i, info := range nodes {
+		ids[i] = info.Id
+	}
+	return ids
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// one event of a capture to be sent again
+type replayEvent struct {
+	at   float64 // original time used for pacing
+	node string
+	seq  uint64 // 0 when the capture has none
+	hash string
+}
+
+// recognised capture lines:
+//
+//	logger log.txt  "<date> <time> <send> <recv> <bytes> ... [<node> ...]" paced by recv
+//	logger tail     "<recv> <send> <node> <seq> <hash>"                      paced by recv
+//	node payload    "<send> <node> <seq> <hash>"                             paced by send
+//	generator.py    "<send> <hash>"                                          paced by send
+func parseCaptureLine(line string, defaultNode string) (replayEvent, bool) {
+	fields := strings.Fields(line)
+	number := func(i int) (float64, bool) {
+		if i >= len(fields) {
+			return 0, false
+		}
+		v, err := strconv.ParseFloat(fields[i], 64)
+		return v, err == nil
+	}
+	hashOf := func() string {
+		sum := sha256.Sum256([]byte(line))
+		return hex.EncodeToString(sum[:])
+	}
+
+	switch {
+	case len(fields) >= 5 && strings.Contains(fields[0], "/"):
+		recv, ok := number(3)
+		if !ok {
+			return replayEvent{}, false
+		}
+		ev := replayEvent{at: recv, node: defaultNode, hash: hashOf()}
+		if len(fields) > 8 && fields[8] != "-" {
+			ev.node = fields[8]
+		}
+		return ev, true
+	case len(fields) == 5:
+		recv, ok := number(0)
+		seq, err := strconv.ParseUint(fields[3], 10, 64)
+		if !ok || err != nil {
+			return replayEvent{}, false
+		}
+		return replayEvent{at: recv, node: fields[2], seq: seq, hash: fields[4]}, true
+	case len(fields) == 4:
+		send, ok := number(0)
+		seq, err := strconv.ParseUint(fields[2], 10, 64)
+		if !ok || err != nil {
+			return replayEvent{}, false
+		}
+		return replayEvent{at: send, node: fields[1], seq: seq, hash: fields[3]}, true
+	case len(fields) == 2:
+		send, ok := number(0)
+		if !ok {
+			return replayEvent{}, false
+		}
+		return replayEvent{at: send, node: defaultNode, hash: fields[1]}, true
+	}
+	return replayEvent{}, false
+}
+
+func readCapture(r io.Reader, defaultNode string) ([]replayEvent, error) {
+	var events []replayEvent
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if ev, ok := parseCaptureLine(s.Text(), defaultNode); ok {
+			events = append(events, ev)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+	return events, s.Err()
+}
+
+// one connection per original node, answering the logger's clock sync like a real node
+type replayConn struct {
+	conn net.Conn
+	lock sync.Mutex
+	seq  uint64
+}
+
+func dialReplay(address string, node string) (*replayConn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	c := &replayConn{conn: conn}
+	if err := c.write(typeConnect, []byte(timestampNow()+" - "+node+" connected")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go answerSync(conn, c.write)
+	return c, nil
+}
+
+func (c *replayConn) write(frameType byte, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := writeFrame(c.conn, frameType, payload)
+	return err
+}
+
+// logger replay [-speed x] [-node id] capture address:port
+func replayCommand(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "replay speed multiplier, 0 sends as fast as possible")
+	defaultNode := fs.String("node", "replay", "node id for captures that do not record one")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		log.Fatal("Please enter the capture file and the logger address:port in the command line")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	events, err := readCapture(f, *defaultNode)
+	f.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(events) == 0 {
+		log.Fatal("No events in ", fs.Arg(0))
+	}
+
+	conns := make(map[string]*replayConn)
+	defer func() {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	base := events[0].at
+	for i, ev := range events {
+		if *speed > 0 {
+			offset := time.Duration((ev.at - base) / *speed * float64(time.Second))
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		c, ok := conns[ev.node]
+		if !ok {
+			if c, err = dialReplay(fs.Arg(1), ev.node); err != nil {
+				log.Fatal("Connection Failed", err)
+			}
+			conns[ev.node] = c
+		}
+		// keep the sequence numbers of captures that record them so the logger sees the same gaps.
+		// log.txt lines do not, their events are numbered without gaps and the original gaps are lost
+		seq := ev.seq
+		if seq == 0 {
+			c.seq++
+			seq = c.seq
+		}
+		payload := timestampNow() + " " + ev.node + " " + strconv.FormatUint(seq, 10) + " " + ev.hash
+		if err := c.write(typeEvent, []byte(payload)); err != nil {
+			log.Fatal("Error! ", err)
+		}
+
+		if (i+1)%1000 == 0 {
+			fmt.Println("Replayed", i+1, "of", len(events), "events")
+		}
+	}
+	fmt.Println("Replayed", len(events), "events from", len(conns), "nodes in", time.Since(start).Round(time.Millisecond))
+}
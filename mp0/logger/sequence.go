@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// gaps larger than this are counted as lost but not remembered individually
+const maxTrackedGap = 10000
+
+// per-node sequence number bookkeeping, detects lost, duplicated and reordered events
+type SeqTracker struct {
+	lock       sync.Mutex
+	next       uint64          // next expected sequence number
+	missing    map[uint64]bool // sequence numbers skipped over that may still arrive late
+	received   int
+	lost       int // skipped and not (yet) seen
+	duplicates int
+	reordered  int // arrived after a higher sequence number
+}
+
+type SeqStats struct {
+	Received   int
+	Lost       int
+	Duplicates int
+	Reordered  int
+}
+
+func NewSeqTracker() *SeqTracker {
+	return &SeqTracker{next: 1, missing: make(map[uint64]bool)}
+}
+
+// record a sequence number, returns a description of any anomaly or "" if it was in order
+func (t *SeqTracker) Observe(seq uint64) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.received++
+	switch {
+	case seq == t.next:
+		t.next++
+		return ""
+	case seq > t.next:
+		gap := seq - t.next
+		if gap <= maxTrackedGap {
+			for s := t.next; s < seq; s++ {
+				t.missing[s] = true
+			}
+		}
+		t.lost += int(gap)
+		report := fmt.Sprintf("gap: missing seq %d-%d", t.next, seq-1)
+		if gap == 1 {
+			report = fmt.Sprintf("gap: missing seq %d", t.next)
+		}
+		t.next = seq + 1
+		return report
+	case t.missing[seq]:
+		// checked before a restart, a late seq 1 is just reordered
+		delete(t.missing, seq)
+		t.lost--
+		t.reordered++
+		return fmt.Sprintf("seq %d arrived out of order", seq)
+	case seq == 1:
+		// the node restarted and counts from the beginning again
+		t.next = 2
+		t.missing = make(map[uint64]bool)
+		return "sequence restarted"
+	default:
+		t.duplicates++
+		return fmt.Sprintf("duplicate seq %d", seq)
+	}
+}
+
+func (t *SeqTracker) Stats() SeqStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return SeqStats{Received: t.received, Lost: t.lost, Duplicates: t.duplicates, Reordered: t.reordered}
+}
+
+// share of the expected events that never arrived
+func (s SeqStats) LossRate() float64 {
+	expected := s.Received - s.Duplicates + s.Lost
+	if expected <= 0 {
+		return 0
+	}
+	return float64(s.Lost) / float64(expected)
+}
+
+// share of the received events that arrived after a later one
+func (s SeqStats) ReorderRate() float64 {
+	if s.Received == 0 {
+		return 0
+	}
+	return float64(s.Reordered) / float64(s.Received)
+}
+
+func (s SeqStats) String() string {
+	return fmt.Sprintf("received %d, lost %d (%.2f%%), duplicates %d, reordered %d (%.2f%%)",
+		s.Received, s.Lost, s.LossRate()*100, s.Duplicates, s.Reordered, s.ReorderRate()*100)
+}
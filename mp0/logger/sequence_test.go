@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func observeAll(t *SeqTracker, seqs ...uint64) (reports []string) {
+	for _, seq := range seqs {
+		if report := t.Observe(seq); report != "" {
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+func seqRange(first uint64, last uint64) []uint64 {
+	var seqs []uint64
+	for seq := first; seq <= last; seq++ {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func TestSeqTracker(t *testing.T) {
+	tests := []struct {
+		name    string
+		seqs    []uint64
+		stats   SeqStats
+		reports []string
+	}{
+		{
+			name:  "in order",
+			seqs:  seqRange(1, 10),
+			stats: SeqStats{Received: 10},
+		},
+		{
+			name:    "gap",
+			seqs:    []uint64{1, 2, 5, 6},
+			stats:   SeqStats{Received: 4, Lost: 2},
+			reports: []string{"gap: missing seq 3-4"},
+		},
+		{
+			name:    "late arrival",
+			seqs:    []uint64{1, 3, 2, 4},
+			stats:   SeqStats{Received: 4, Reordered: 1},
+			reports: []string{"gap: missing seq 2", "seq 2 arrived out of order"},
+		},
+		{
+			name:    "late seq 1",
+			seqs:    append(append(seqRange(2, 51), 1), seqRange(52, 60)...),
+			stats:   SeqStats{Received: 60, Reordered: 1},
+			reports: []string{"gap: missing seq 1", "seq 1 arrived out of order"},
+		},
+		{
+			name:    "duplicate",
+			seqs:    []uint64{1, 2, 2, 3},
+			stats:   SeqStats{Received: 4, Duplicates: 1},
+			reports: []string{"duplicate seq 2"},
+		},
+		{
+			name:    "restart",
+			seqs:    []uint64{1, 2, 3, 1, 2},
+			stats:   SeqStats{Received: 5},
+			reports: []string{"sequence restarted"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewSeqTracker()
+			reports := observeAll(tracker, test.seqs...)
+			if stats := tracker.Stats(); stats != test.stats {
+				t.Errorf("stats %+v, want %+v", stats, test.stats)
+			}
+			if len(reports) != len(test.reports) {
+				t.Fatalf("reports %q, want %q", reports, test.reports)
+			}
+			for i := range reports {
+				if reports[i] != test.reports[i] {
+					t.Errorf("report %d %q, want %q", i, reports[i], test.reports[i])
+				}
+			}
+		})
+	}
+}
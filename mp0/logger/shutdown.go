@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long open connections may keep delivering after a shutdown signal
+var drainTimeout = 2 * time.Second
+
+// log.txt while the logger is not writing segments, synced on shutdown
+var logFile *os.File
+
+// open node, subscriber and child logger connections, drained on shutdown
+type Connections struct {
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+	wait  sync.WaitGroup
+}
+
+var connections = Connections{conns: make(map[net.Conn]bool)}
+
+func (c *Connections) Add(conn net.Conn) {
+	c.lock.Lock()
+	c.conns[conn] = true
+	c.wait.Add(1)
+	c.lock.Unlock()
+}
+
+func (c *Connections) Done(conn net.Conn) {
+	c.lock.Lock()
+	if c.conns[conn] {
+		delete(c.conns, conn)
+		c.wait.Done()
+	}
+	c.lock.Unlock()
+}
+
+// let every connection read for up to timeout more, then cut off whatever is still open
+func (c *Connections) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	c.lock.Lock()
+	for conn := range c.conns {
+		conn.SetReadDeadline(deadline)
+	}
+	c.lock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		c.wait.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout + time.Second):
+		c.lock.Lock()
+		for conn := range c.conns {
+			conn.Close()
+		}
+		c.lock.Unlock()
+	}
+}
+
+// totals of every node seen since the start, written to the log as the last records
+func writeSummary() {
+	ids := registry.SequenceIds()
+	for _, id := range ids {
+		line := "summary " + id + " " + registry.Sequence(id).Stats().String()
+		if limits := limiter.Report(id); limits != "" {
+			line += " | " + limits
+		}
+		fmt.Println(line)
+		if storage != nil {
+			storage.Note(line)
+		} else {
+			log.Println(line)
+		}
+	}
+	fmt.Println("Final summary for", len(ids), "nodes:", strings.Join(ids, " "))
+}
+
+// flush everything that is buffered and make the log durable
+func finishLogger() {
+	if upstream != nil {
+		upstream.Flush(drainTimeout)
+	}
+	writeSummary()
+	if storage != nil {
+		if err := storage.Close(); err != nil {
+			fmt.Println("Cannot close segments", err)
+		}
+	} else if logFile != nil {
+		if err := logFile.Sync(); err != nil {
+			fmt.Println("Cannot sync log file", err)
+		}
+		logFile.Close()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// delays and bytes seen during the current reporting interval
+type window struct {
+	delays []float64 // seconds
+	bytes  int
+}
+
+func (w *window) add(delay float64, bytes int) {
+	w.delays = append(w.delays, delay)
+	w.bytes += bytes
+}
+
+// rolling delay/bandwidth statistics, per node and over all nodes
+type Stats struct {
+	lock   sync.Mutex
+	start  time.Time // start of the current interval
+	global window
+	nodes  map[string]*window
+}
+
+var stats = Stats{start: time.Now(), nodes: make(map[string]*window)}
+
+func (s *Stats) Record(node string, delay float64, bytes int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.global.add(delay, bytes)
+	w, ok := s.nodes[node]
+	if !ok {
+		w = &window{}
+		s.nodes[node] = w
+	}
+	w.add(delay, bytes)
+}
+
+// hand out the current interval and start a new one
+func (s *Stats) Snapshot() (global window, nodes map[string]*window, elapsed float64, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now = time.Now()
+	elapsed = now.Sub(s.start).Seconds()
+	global = s.global
+	nodes = s.nodes
+	s.start = now
+	s.global = window{}
+	s.nodes = make(map[string]*window)
+	return global, nodes, elapsed, now
+}
+
+// summarise the current interval and start a new one
+func (s *Stats) Report(out io.Writer) {
+	global, nodes, elapsed, now := s.Snapshot()
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	timestamp := formatTimestamp(now)
+	if limits := limiter.Summary(); limits != "" {
+		fmt.Fprintln(out, timestamp, "all", summarise(global, elapsed), "|", limits)
+	} else {
+		fmt.Fprintln(out, timestamp, "all", summarise(global, elapsed))
+	}
+	for _, id := range ids {
+		if limits := limiter.Report(id); limits != "" {
+			fmt.Fprintln(out, timestamp, id, summarise(*nodes[id], elapsed), "|", registry.Sequence(id).Stats(), "|", limits)
+		} else {
+			fmt.Fprintln(out, timestamp, id, summarise(*nodes[id], elapsed), "|", registry.Sequence(id).Stats())
+		}
+	}
+}
+
+// "events=N delay_ms min=.. median=.. p90=.. max=.. bytes/s=.."
+func summarise(w window, elapsed float64) string {
+	sort.Float64s(w.delays)
+	bandwidth := 0.0
+	if elapsed > 0 {
+		bandwidth = float64(w.bytes) / elapsed
+	}
+	if len(w.delays) == 0 {
+		return fmt.Sprintf("events=0 bytes/s=%.1f", bandwidth)
+	}
+	return fmt.Sprintf("events=%d delay_ms min=%.3f median=%.3f p90=%.3f max=%.3f bytes/s=%.1f",
+		len(w.delays),
+		w.delays[0]*1000,
+		percentile(w.delays, 50)*1000,
+		percentile(w.delays, 90)*1000,
+		w.delays[len(w.delays)-1]*1000,
+		bandwidth)
+}
+
+// nearest-rank percentile of an already sorted slice
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// write a summary every second to path ("-" for stdout)
+func reportStats(path string) {
+	out := io.Writer(os.Stdout)
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			fmt.Println("Cannot open stats file", err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		stats.Report(out)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const indexFile = "index.json"
+
+// what one segment file covers, the index lets queries skip segments
+type SegmentInfo struct {
+	Name   string   `json:"name"`
+	Start  float64  `json:"start"` // receive time of the first event
+	End    float64  `json:"end"`   // receive time of the last event
+	Nodes  []string `json:"nodes"`
+	Events int      `json:"events"`
+	Size   int64    `json:"size"`
+}
+
+// event log split over segment files, rotated by size or age and pruned by retention limits
+type Storage struct {
+	lock sync.Mutex
+	dir  string
+
+	maxSize     int64         // rotate once a segment is this big, 0 for no limit
+	maxAge      time.Duration // rotate once a segment is this old, 0 for no limit
+	keepCount   int           // segments to keep, 0 for no limit
+	keepAge     time.Duration // drop segments whose last event is older, 0 for no limit
+	nextSegment int
+
+	index   []SegmentInfo // the last entry is the open segment
+	nodes   map[string]bool
+	opened  time.Time
+	file    *os.File
+	out     *log.Logger // same line format as log.txt
+	changed bool        // index not yet written since the last append
+}
+
+// segment storage, nil while the logger writes the single log.txt
+var storage *Storage
+
+func OpenStorage(dir string, maxSize int64, maxAge time.Duration, keepCount int, keepAge time.Duration) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	index, err := readIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Storage{
+		dir:       dir,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		keepCount: keepCount,
+		keepAge:   keepAge,
+		index:     index,
+	}
+	// continue numbering after whatever an earlier run left behind
+	for _, seg := range index {
+		var n int
+		if _, err := fmt.Sscanf(seg.Name, "segment-%d.log", &n); err == nil && n >= s.nextSegment {
+			s.nextSegment = n + 1
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	go s.flushIndex()
+	return s, nil
+}
+
+// append a log line for an event of node received at the given time
+func (s *Storage) Append(node string, received time.Time, line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := &s.index[len(s.index)-1]
+	if (s.maxSize > 0 && current.Size >= s.maxSize) || (s.maxAge > 0 && time.Since(s.opened) >= s.maxAge) {
+		if err := s.rotate(); err != nil {
+			fmt.Println("Cannot rotate segment", err)
+		}
+		current = &s.index[len(s.index)-1]
+	}
+
+	s.out.Println(line)
+	if info, err := s.file.Stat(); err == nil {
+		current.Size = info.Size()
+	}
+	at := float64(received.UnixNano()) / float64(1000000000)
+	if current.Events == 0 {
+		current.Start = at
+	}
+	current.End = at
+	current.Events++
+	if !s.nodes[node] {
+		s.nodes[node] = true
+		current.Nodes = append(current.Nodes, node)
+		sort.Strings(current.Nodes)
+	}
+	s.changed = true
+}
+
+// write a line that is not an event, e.g. the shutdown summary
+func (s *Storage) Note(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.out.Println(line)
+}
+
+// sync and close the open segment and write the final index
+func (s *Storage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if info, err := s.file.Stat(); err == nil {
+		s.index[len(s.index)-1].Size = info.Size()
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	return s.writeIndex()
+}
+
+// close the open segment, start a new one and apply retention. caller holds the lock
+func (s *Storage) rotate() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	// an empty segment is dropped instead of piling up
+	if n := len(s.index); n > 0 && s.file != nil && s.index[n-1].Events == 0 {
+		os.Remove(filepath.Join(s.dir, s.index[n-1].Name))
+		s.index = s.index[:n-1]
+	}
+
+	name := fmt.Sprintf("segment-%06d.log", s.nextSegment)
+	s.nextSegment++
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.out = log.New(f, "", log.LstdFlags)
+	s.opened = time.Now()
+	s.nodes = make(map[string]bool)
+	s.index = append(s.index, SegmentInfo{Name: name})
+
+	s.prune()
+	return s.writeIndex()
+}
+
+// drop the oldest closed segments beyond the retention limits. caller holds the lock
+func (s *Storage) prune() {
+	cutoff := float64(time.Now().Add(-s.keepAge).UnixNano()) / float64(1000000000)
+	for len(s.index) > 1 {
+		oldest := s.index[0]
+		tooMany := s.keepCount > 0 && len(s.index) > s.keepCount
+		tooOld := s.keepAge > 0 && oldest.End < cutoff
+		if !tooMany && !tooOld {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, oldest.Name)); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Cannot remove segment", err)
+			break
+		}
+		s.index = s.index[1:]
+	}
+}
+
+// the open segment's entry changes with every event, write it out once a second
+func (s *Storage) flushIndex() {
+	for range time.Tick(time.Second) {
+		s.lock.Lock()
+		if s.changed {
+			if err := s.writeIndex(); err != nil {
+				fmt.Println("Cannot write segment index", err)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// caller holds the lock
+func (s *Storage) writeIndex() error {
+	data, err := json.MarshalIndent(s.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename so a query never sees a half written index
+	tmp := filepath.Join(s.dir, indexFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	s.changed = false
+	return os.Rename(tmp, filepath.Join(s.dir, indexFile))
+}
+
+func readIndex(dir string) ([]SegmentInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index []SegmentInfo
+	err = json.Unmarshal(data, &index)
+	return index, err
+}
+
+func (seg SegmentInfo) hasNode(node string) bool {
+	i := sort.SearchStrings(seg.Nodes, node)
+	return i < len(seg.Nodes) && seg.Nodes[i] == node
+}
+
+// logger query -dir segments [-node id] [-from ts] [-to ts]
+func queryCommand(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	dir := fs.String("dir", "segments", "segment directory of the logger")
+	node := fs.String("node", "", "node id, all nodes when empty")
+	from := fs.Float64("from", 0, "start of the window, unix seconds of the receive time")
+	to := fs.Float64("to", 0, "end of the window, unix seconds of the receive time, 0 for now")
+	fs.Parse(args)
+
+	if *to == 0 {
+		*to = float64(time.Now().UnixNano()) / float64(1000000000)
+	}
+	index, err := readIndex(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for i, seg := range index {
+		// the open segment's index entry may lag by a second, always look inside it
+		open := i == len(index)-1
+		if !open && (seg.End < *from || (*node != "" && !seg.hasNode(*node))) {
+			continue
+		}
+		if seg.Events > 0 && seg.Start > *to {
+			continue
+		}
+		if err := scanSegment(filepath.Join(*dir, seg.Name), *node, *from, *to, out); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// print the lines of a segment for node (any node when empty) received in [from, to]
+func scanSegment(path string, node string, from float64, to float64, out *bufio.Writer) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil // pruned since the index was read
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// "<date> <time> <send> <recv> <bytes> <raw> <corrected> <bound> <node> [delayed]"
+		fields := strings.Fields(s.Text())
+		if len(fields) < 9 {
+			continue
+		}
+		if node != "" && fields[8] != node {
+			continue
+		}
+		received, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil || received < from || received > to {
+			continue
+		}
+		fmt.Fprintln(out, s.Text())
+	}
+	return s.Err()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	subscriberBuffer   = 1024  // events queued per subscriber
+	maxSubscriberDrops = 10000 // consecutive drops before a subscriber is cut off
+)
+
+// a connection tailing the ingested events
+type Subscriber struct {
+	address string
+	nodes   map[string]bool // empty for every node
+	events  chan string
+	dropped int // consecutive events dropped because the subscriber fell behind
+	lost    int // total events dropped
+}
+
+// subscribers never block ingestion: a full queue drops the event for that subscriber
+type Subscribers struct {
+	lock sync.Mutex
+	subs map[*Subscriber]bool
+}
+
+var subscribers = Subscribers{subs: make(map[*Subscriber]bool)}
+
+func (s *Subscribers) Add(sub *Subscriber) {
+	s.lock.Lock()
+	s.subs[sub] = true
+	s.lock.Unlock()
+}
+
+func (s *Subscribers) Remove(sub *Subscriber) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.subs[sub] {
+		delete(s.subs, sub)
+		close(sub.events)
+	}
+}
+
+// hand an ingested event to every interested subscriber
+func (s *Subscribers) Publish(node string, payload string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for sub := range s.subs {
+		if len(sub.nodes) > 0 && !sub.nodes[node] {
+			continue
+		}
+		select {
+		case sub.events <- payload:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+			sub.lost++
+			if sub.dropped >= maxSubscriberDrops {
+				fmt.Println("Subscriber", sub.address, "is too slow, disconnecting after", sub.lost, "dropped events")
+				delete(s.subs, sub)
+				close(sub.events)
+			}
+		}
+	}
+}
+
+// stream events to a connection that opened with a subscribe frame, filter is "<node>,<node>..."
+func serveSubscriber(conn net.Conn, r *bufio.Reader, filter string) {
+	sub := &Subscriber{
+		address: conn.RemoteAddr().String(),
+		nodes:   make(map[string]bool),
+		events:  make(chan string, subscriberBuffer),
+	}
+	for _, id := range strings.Split(filter, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			sub.nodes[id] = true
+		}
+	}
+	subscribers.Add(sub)
+	fmt.Println("Subscriber", sub.address, "attached, nodes:", filter)
+
+	// subscribers send nothing after the subscribe frame, a read error means they left
+	go func() {
+		for {
+			if _, _, err := readFrame(r); err != nil {
+				subscribers.Remove(sub)
+				return
+			}
+		}
+	}()
+
+	for payload := range sub.events {
+		if _, err := writeFrame(conn, typeEvent, []byte(payload)); err != nil {
+			subscribers.Remove(sub)
+			break
+		}
+	}
+	fmt.Println("Subscriber", sub.address, "detached")
+}
+
+// logger tail [-nodes n1,n2] [-tls-ca ca.pem [-tls-cert c.pem -tls-key k.pem]] address:port
+func tailCommand(args []string) {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	nodes := fs.String("nodes", "", "comma separated node ids to follow, all nodes when empty")
+	tlsCA := fs.String("tls-ca", "", "ca of the logger certificate, enables tls")
+	tlsCert := fs.String("tls-cert", "", "client certificate when the logger requires one")
+	tlsKey := fs.String("tls-key", "", "client private key")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		log.Fatal("Please enter the logger address:port in the command line")
+	}
+
+	var conn net.Conn
+	var err error
+	if *tlsCA != "" {
+		var config *tls.Config
+		if config, err = clientTLSConfig(*tlsCA, *tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+		conn, err = tls.Dial("tcp", fs.Arg(0), config)
+	} else {
+		conn, err = net.Dial("tcp", fs.Arg(0))
+	}
+	if err != nil {
+		log.Fatal("Connection Failed", err)
+	}
+	defer conn.Close()
+	if _, err := writeFrame(conn, typeSubscribe, []byte(*nodes)); err != nil {
+		log.Fatal("Connection Failed", err)
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, _, err := readFrame(r)
+		if err != nil {
+			log.Fatal("Error! ", err)
+		}
+		fmt.Println(string(frame.Payload))
+	}
+}
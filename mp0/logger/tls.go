@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// server side tls, with a client ca every node has to present a certificate signed by it
+func serverTLSConfig(certPath string, keyPath string, caPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caPath != "" {
+		pool, err := loadCertPool(caPath)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// client side tls for subcommands talking to a logger, certificate optional
+func clientTLSConfig(caPath string, certPath string, keyPath string) (*tls.Config, error) {
+	pool, err := loadCertPool(caPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in " + path)
+	}
+	return pool, nil
+}
+
+// node id from the verified client certificate, "" for plain tcp or no certificate
+func peerIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	return certs[0].Subject.CommonName, nil
+}
+
+// logger gencert [-out dir] [-hosts h1,h2] node1 node2 ...
+// writes a throwaway ca, a logger certificate and one client certificate per node (CN = node id)
+func gencertCommand(args []string) {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	out := fs.String("out", "certs", "output directory")
+	hosts := fs.String("hosts", "localhost,127.0.0.1", "comma separated dns names / ips of the logger")
+	days := fs.Int("days", 365, "validity in days")
+	fs.Parse(args)
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatal(err)
+	}
+	validFor := time.Duration(*days) * 24 * time.Hour
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caTemplate := certTemplate("mp0 test CA", validFor)
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		log.Fatal(err)
+	}
+	writeKeyPair(*out, "ca", caDER, caKey)
+
+	issue := func(name string, usage x509.ExtKeyUsage, sans []string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		template := certTemplate(name, validFor)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		for _, san := range sans {
+			if ip := net.ParseIP(san); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else if san != "" {
+				template.DNSNames = append(template.DNSNames, san)
+			}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeKeyPair(*out, name, der, key)
+	}
+
+	issue("logger", x509.ExtKeyUsageServerAuth, strings.Split(*hosts, ","))
+	for _, node := range fs.Args() {
+		issue(node, x509.ExtKeyUsageClientAuth, nil)
+	}
+	log.Println("Certificates written to", *out)
+}
+
+func certTemplate(commonName string, validFor time.Duration) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+}
+
+// <name>.pem and <name>-key.pem
+func writeKeyPair(dir string, name string, der []byte, key *ecdsa.PrivateKey) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// udp has no disconnects, a node that stays silent this long is considered gone
+const udpIdleTimeout = 30 * time.Second
+
+// what the logger knows about one udp sender
+type udpPeer struct {
+	addr     net.Addr
+	node     *NodeInfo
+	clock    *ClockEstimate
+	done     chan struct{} // stops the clock sync rounds
+	lastSeen time.Time
+}
+
+// lets the tcp code paths (clock sync) write frames to a udp peer
+type udpWriter struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+func (w udpWriter) Write(b []byte) (int, error) {
+	return w.conn.WriteTo(b, w.addr)
+}
+
+// receive one event per datagram, sequence numbers in the payload expose loss and reordering
+func serveUDP(conn net.PacketConn) error {
+	var lock sync.Mutex
+	peers := make(map[string]*udpPeer)
+
+	// forget peers that went quiet, the udp counterpart of a disconnect
+	go func() {
+		for range time.Tick(udpIdleTimeout / 3) {
+			lock.Lock()
+			for key, peer := range peers {
+				if time.Since(peer.lastSeen) < udpIdleTimeout {
+					continue
+				}
+				delete(peers, key)
+				close(peer.done)
+				if peer.node != nil {
+					registry.Leave(peer.node)
+					fmt.Println(timestampNow() + " - " + peer.node.Id + " disconnected (idle)")
+					fmt.Println(peer.node.Id+" summary:", registry.Sequence(peer.node.Id).Stats(), "|", peer.clock)
+					fmt.Println("Attached nodes:", strings.Join(registry.Ids(), " "))
+				}
+			}
+			lock.Unlock()
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		received := time.Now()
+		frame, size, err := readFrame(bytes.NewReader(buf[:n]))
+		if err != nil {
+			fmt.Println("Malformed datagram from", addr, err)
+			continue
+		}
+
+		lock.Lock()
+		peer, ok := peers[addr.String()]
+		if !ok {
+			peer = &udpPeer{addr: addr, clock: &ClockEstimate{}, done: make(chan struct{})}
+			peers[addr.String()] = peer
+		}
+		peer.lastSeen = received
+		lock.Unlock()
+
+		message := string(frame.Payload)
+		switch frame.Type {
+		case typeConnect:
+			// "<ts> - <node> connected", resent by the node now and then
+			parts := strings.Split(message, " ")
+			lock.Lock()
+			if peer.node == nil && len(parts) > 2 {
+				peer.node = registry.Join(parts[2], addr.String())
+				go syncClock(udpWriter{conn, addr}, peer.done)
+				fmt.Println(message)
+				fmt.Println("Attached nodes:", strings.Join(registry.Ids(), " "))
+			}
+			lock.Unlock()
+		case typeSyncReply:
+			peer.clock.Reply(message, received)
+		case typeEvent, typeDelayed:
+			ev := newEvent(message, received, size)
+			ev.Delayed = frame.Type == typeDelayed
+			ev.Clock = peer.clock
+			ingestEvent(ev)
+		case typeBatch:
+			events, err := unpackBatch(frame.Payload, received, size)
+			if err != nil {
+				fmt.Println("Malformed batch from", addr, err)
+				continue
+			}
+			for _, ev := range events {
+				ev.Clock = peer.clock
+				ingestEvent(ev)
+			}
+		default:
+			fmt.Println("Unsupported frame type", frame.Type, "over udp from", addr)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// name of this logger in hop lists, set with -id
+var loggerId string
+
+// parent logger everything ingested here is forwarded to, nil for the root
+var upstream *Upstream
+
+// names of the loggers allowed to forward events here, set with -child-loggers
+var childLoggers = make(map[string]bool)
+
+// whether a peer may send typeForward frames. with client certificates only
+// listed loggers may, without them the list is checked against the connect
+// name when one is given and everyone may forward otherwise
+func isChildLogger(name string, authenticated bool) bool {
+	if authenticated || len(childLoggers) > 0 {
+		return childLoggers[name]
+	}
+	return true
+}
+
+// connection to the parent logger, reconnects with backoff and buffers while it is down
+type Upstream struct {
+	address string
+	tls     *tls.Config // nil for plain tcp
+	queue   chan []byte
+
+	lock    sync.Mutex
+	unsent  int // events queued or being written, held ones included, Flush waits for 0
+	dropped int // events thrown away because the queue was full
+
+	writeLock sync.Mutex // forwarded events and sync replies share the connection
+}
+
+func NewUpstream(address string, limit int, tlsConfig *tls.Config) *Upstream {
+	u := &Upstream{
+		address: address,
+		tls:     tlsConfig,
+		queue:   make(chan []byte, limit),
+	}
+	go u.run()
+	return u
+}
+
+// queue an ingested event for the parent with this logger added to its hops,
+// the oldest event is dropped when the queue is full
+func (u *Upstream) Forward(ev *Event) {
+	hops := append(ev.Hops[:len(ev.Hops):len(ev.Hops)], Hop{
+		Logger:   loggerId,
+		Received: float64(ev.Received.UnixNano()) / float64(1000000000),
+	})
+	payload := []byte(formatHops(hops) + " " + ev.Payload)
+	// counted before it is queued so Flush never sees it missing
+	u.lock.Lock()
+	u.unsent++
+	u.lock.Unlock()
+	for {
+		select {
+		case u.queue <- payload:
+			return
+		default:
+		}
+		select {
+		case <-u.queue:
+			u.lock.Lock()
+			u.dropped++
+			u.unsent--
+			u.lock.Unlock()
+		default:
+		}
+	}
+}
+
+// wait up to timeout for the queued events, and one held for a reconnect, to go out
+func (u *Upstream) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		u.lock.Lock()
+		n := u.unsent
+		u.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			fmt.Println(n, "events for upstream logger", u.address, "not forwarded at shutdown")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// to the parent this logger looks like a node named loggerId
+func (u *Upstream) dial() net.Conn {
+	backoff := minBackoff
+	for {
+		var conn net.Conn
+		var err error
+		if u.tls != nil {
+			conn, err = tls.Dial("tcp", u.address, u.tls)
+		} else {
+			conn, err = net.Dial("tcp", u.address)
+		}
+		if err == nil {
+			_, err = writeFrame(conn, typeConnect, []byte(timestampNow()+" - "+loggerId+" connected"))
+			if err == nil {
+				fmt.Println("Connected to upstream logger", u.address)
+				return conn
+			}
+			conn.Close()
+		}
+
+		fmt.Println("Connection to upstream logger", u.address, "failed:", err, "- retrying in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (u *Upstream) write(conn net.Conn, frameType byte, payload []byte) error {
+	u.writeLock.Lock()
+	defer u.writeLock.Unlock()
+	_, err := writeFrame(conn, frameType, payload)
+	return err
+}
+
+// the parent measures our clock like any node's, a dead connection wakes up the writer
+func (u *Upstream) answerSync(conn net.Conn) {
+	answerSync(conn, func(frameType byte, payload []byte) error {
+		return u.write(conn, frameType, payload)
+	})
+	conn.Close()
+}
+
+func (u *Upstream) run() {
+	var pending []byte // event whose write failed, resent first after reconnecting
+	for {
+		conn := u.dial()
+		go u.answerSync(conn)
+
+		u.lock.Lock()
+		if u.dropped > 0 {
+			fmt.Println(u.dropped, "events for upstream logger", u.address, "dropped while disconnected")
+			u.dropped = 0
+		}
+		u.lock.Unlock()
+
+		for {
+			if pending == nil {
+				pending = <-u.queue
+			}
+			if err := u.write(conn, typeForward, pending); err != nil {
+				fmt.Println("Lost connection to upstream logger", u.address, err)
+				conn.Close()
+				break
+			}
+			u.lock.Lock()
+			u.unsent--
+			u.lock.Unlock()
+			pending = nil
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// how events are grouped into typeBatch frames, Size <= 1 sends every event on its own
+type Batching struct {
+	Size  int           // events per batch at most
+	Wait  time.Duration // how long the first event of a batch waits for company
+	Codec byte
+}
+
+func parseCodec(name string) (byte, error) {
+	switch name {
+	case "none":
+		return codecNone, nil
+	case "gzip":
+		return codecGzip, nil
+	case "flate":
+		return codecFlate, nil
+	}
+	return 0, fmt.Errorf("unknown codec %q, expected none, gzip or flate", name)
+}
+
+// block for the next event, then gather more until the batch is full or its time is up
+func (u *Uplink) collect() []pendingEvent {
+	events := []pendingEvent{<-u.queue}
+	if u.batching.Size <= 1 {
+		return events
+	}
+	// whatever is queued already goes along without waiting
+	timer := time.NewTimer(u.batching.Wait)
+	defer timer.Stop()
+	for len(events) < u.batching.Size {
+		select {
+		case ev := <-u.queue:
+			events = append(events, ev)
+		case <-timer.C:
+			return events
+		}
+	}
+	return events
+}
+
+// write events as one frame each, or as a single batch frame when there are several.
+// anything queued while a broken connection was down is part of the backlog and goes out as typeDelayed
+func (u *Uplink) writeEvents(conn net.Conn, events []pendingEvent) (delayed int, err error) {
+	frames := make([]Frame, len(events))
+	for i, ev := range events {
+		frames[i] = Frame{Type: typeEvent, Payload: ev.payload}
+		if ev.backlog {
+			frames[i].Type = typeDelayed
+			delayed++
+		}
+	}
+	if len(frames) == 1 {
+		_, err = u.write(conn, frames[0].Type, frames[0].Payload)
+		return delayed, err
+	}
+	payload, err := encodeBatch(u.batching.Codec, frames)
+	if err != nil {
+		return 0, err
+	}
+	_, err = u.write(conn, typeBatch, payload)
+	return delayed, err
+}
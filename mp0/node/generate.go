@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parse "rate[,max]", max 0 means unlimited
+func parseGenerate(spec string) (rate float64, max int, err error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) > 2 {
+		return 0, 0, errors.New("expected rate[,max]")
+	}
+	rate, err = strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, errors.New("rate must be a positive number")
+	}
+	if len(parts) == 2 {
+		max, err = strconv.Atoi(parts[1])
+		if err != nil || max < 0 {
+			return 0, 0, errors.New("max must be a non-negative integer")
+		}
+	}
+	return rate, max, nil
+}
+
+// native version of generator.py: "<timestamp> <sha256>" lines with
+// exponentially distributed inter-arrival times (Poisson process at rate Hz)
+func generate(rate float64, max int, emit func(string)) {
+	random := make([]byte, 20)
+	for count := 0; max == 0 || count < max; count++ {
+		rand.Read(random)
+		hash := sha256.Sum256(random)
+		emit(timestampNow() + " " + hex.EncodeToString(hash[:]))
+
+		time.Sleep(time.Duration(mathrand.ExpFloat64() / rate * float64(time.Second)))
+	}
+}
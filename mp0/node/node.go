@@ -1,46 +1,173 @@
 package main
 
 import (
-   "log"
-   "net"
-   "os"
-   "bufio"
-   "strings"
-   "time"
-   "strconv"
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// current time in seconds
+func timestampNow() string {
+	time := float64(time.Now().UnixNano()) / float64(1000000000) // time (nanosec) -> float
+	return strconv.FormatFloat(time, 'f', 9, 64)                 // float -> string
+}
+
 func main() {
+	bufferSize := flag.Int("buffer", 10000, "max events buffered while the logger is unreachable")
+	generateSpec := flag.String("generate", "", "generate events natively at rate[,max] instead of reading stdin")
+	tlsCA := flag.String("tls-ca", "", "ca of the logger certificate, enables tls")
+	tlsCert := flag.String("tls-cert", "", "node certificate, its common name is the node id")
+	tlsKey := flag.String("tls-key", "", "node private key")
+	transport := flag.String("transport", "tcp", "tcp, or udp with one datagram per event")
+	batchSize := flag.Int("batch", 0, "send up to this many events per frame, 0 or 1 disables batching")
+	batchWait := flag.Duration("batch-wait", 20*time.Millisecond, "longest an event waits for a batch to fill up")
+	compress := flag.String("compress", "gzip", "codec of batch frames: none, gzip or flate")
+	drainTimeout := flag.Duration("drain", 5*time.Second, "time the queued events get to reach the loggers after SIGINT/SIGTERM")
+	reportEvery := flag.Duration("report", 10*time.Second, "interval of the per-logger delivery report, 0 to disable")
+	flag.Parse()
+
 	var node string
 	var address string
 	var port string
-	if len(os.Args) > 1 {
-		node = os.Args[1]
-		address = os.Args[2]
-		port = os.Args[3]
-	}else {
+	if flag.NArg() > 2 {
+		node = flag.Arg(0)
+		address = flag.Arg(1)
+		port = flag.Arg(2)
+	} else {
 		log.Fatal("Please enter the node number, address, port number in the command line")
 	}
+	// address may list several loggers, "host" uses the port argument, "host:port" its own
+	var loggers []string
+	for _, host := range strings.Split(address, ",") {
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, port)
+		}
+		loggers = append(loggers, host)
+	}
+
+	var rate float64
+	var max int
+	if *generateSpec != "" {
+		var err error
+		rate, max, err = parseGenerate(*generateSpec)
+		if err != nil {
+			log.Fatal("Invalid -generate ", err)
+		}
+	}
+
+	if *transport != "tcp" && *transport != "udp" {
+		log.Fatal("Unknown transport ", *transport)
+	}
+	codec, err := parseCodec(*compress)
+	if err != nil {
+		log.Fatal("Invalid -compress ", err)
+	}
+	batching := Batching{Size: *batchSize, Wait: *batchWait, Codec: codec}
+
+	var tlsConfig *tls.Config
+	if *tlsCA != "" && *transport == "udp" {
+		log.Fatal("TLS is only available with the tcp transport")
+	}
+	if *tlsCA != "" {
+		tlsConfig, err = clientTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal("Invalid tls settings ", err)
+		}
+	}
 
 	log.Println(node, address, port)
 
-   conn, err := net.Dial("tcp", address + ":" + port)
-   if err != nil {
-      log.Fatal("Connection Failed", err)
-   }
-   defer conn.Close()
-   log.Println("Connection Successfully")
-   // send message
-   time := float64(time.Now().UnixNano())/float64(1000000000) // time (nanosec) -> float
-   timestamp := strconv.FormatFloat(time, 'f', 9, 64) // float -> string
-   conn.Write([]byte( timestamp + " - " + node + " connected"))
-
-   	// read log generated by generator.py
-	for{
+	uplinks := make([]*Uplink, len(loggers))
+	for i, logger := range loggers {
+		uplinks[i] = NewUplink(node, logger, *transport, *bufferSize, batching, tlsConfig)
+	}
+	if *reportEvery > 0 {
+		go func() {
+			for range time.Tick(*reportEvery) {
+				for _, uplink := range uplinks {
+					log.Println("Delivery report", uplink.Report())
+				}
+			}
+		}()
+	}
+
+	// one frame per "<timestamp> <hash>" event, each carries a per-node
+	// sequence number so the logger can spot losses
+	var seq uint64
+	var emitLock sync.Mutex
+	stopped := false
+	emit := func(line string) {
+		parts := strings.Split(line, " ")
+		if len(parts) < 2 {
+			return
+		}
+		emitLock.Lock()
+		defer emitLock.Unlock()
+		if stopped {
+			return
+		}
+		seq++
+		payload := []byte(parts[0] + " " + node + " " + strconv.FormatUint(seq, 10) + " " + parts[1])
+		for _, uplink := range uplinks {
+			uplink.Send(seq, payload)
+		}
+	}
+
+	// on SIGINT/SIGTERM stop taking events, give the backlog a chance to get
+	// out and leave with a last delivery report. a second signal exits right away
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Println("Received", sig, "- flushing", len(uplinks), "loggers")
+		emitLock.Lock()
+		stopped = true
+		emitLock.Unlock()
+		go func() {
+			<-signals
+			os.Exit(1)
+		}()
+
+		var wait sync.WaitGroup
+		for _, uplink := range uplinks {
+			wait.Add(1)
+			go func(uplink *Uplink) {
+				defer wait.Done()
+				if !uplink.Flush(*drainTimeout) {
+					log.Println("Gave up flushing", uplink.address, "after", *drainTimeout)
+				}
+				uplink.Close()
+			}(uplink)
+		}
+		wait.Wait()
+		for _, uplink := range uplinks {
+			log.Println("Final delivery report", uplink.Report())
+		}
+		os.Exit(0)
+	}()
+
+	if *generateSpec != "" {
+		generate(rate, max, emit)
+		select {} // keep delivering the backlog, same as after stdin runs out
+	}
+
+	// read log generated by generator.py
+	for {
 		s := bufio.NewScanner(os.Stdin)
 		for s.Scan() {
-			parts := strings.Split(s.Text(), " ")
-			conn.Write([]byte(parts[0] + " " + node + " " + parts[1]))
+			emit(s.Text())
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// tls towards the logger: caPath verifies the logger, the certificate proves who this node is
+func clientTLSConfig(caPath string, certPath string, keyPath string) (*tls.Config, error) {
+	data, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in " + caPath)
+	}
+
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
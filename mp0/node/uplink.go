@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// over udp the connect datagram is repeated so a restarted logger learns who we are again
+const udpHelloInterval = 5 * time.Second
+
+// an event waiting to be written to the logger
+type pendingEvent struct {
+	seq     uint64
+	payload []byte
+	backlog bool // queued while an established connection was down, goes out as typeDelayed
+}
+
+// consecutive sequence numbers, inclusive
+type seqRange struct {
+	first uint64
+	last  uint64
+}
+
+// dropped ranges remembered per logger, older ones are only counted
+const maxDroppedRanges = 16
+
+// connection to one logger that survives logger restarts: it redials with
+// exponential backoff and buffers events in a bounded queue while it is down.
+// every logger gets its own uplink, so a dead one never holds up the others
+type Uplink struct {
+	node     string
+	address  string
+	network  string // "tcp" or "udp"
+	batching Batching
+	tls      *tls.Config // nil for plain tcp
+	queue    chan pendingEvent
+
+	lock      sync.Mutex
+	conn      net.Conn // current connection, nil while dialing
+	unsent    int      // events queued, being batched or being written, Flush waits for 0
+	connected bool
+	outage    bool // an established connection broke and the logger is not back yet, startup is not an outage
+	dropped   int  // events thrown away because the queue was full, since the last reconnect
+	sent      int
+	delayed   int // sent from the backlog after a reconnect
+	missed    int // dropped in total, this logger will never see them
+	ranges    []seqRange
+
+	writeLock sync.Mutex // events and sync replies share the connection
+}
+
+func NewUplink(node string, address string, network string, limit int, batching Batching, tlsConfig *tls.Config) *Uplink {
+	u := &Uplink{
+		node:     node,
+		address:  address,
+		network:  network,
+		batching: batching,
+		tls:      tlsConfig,
+		queue:    make(chan pendingEvent, limit),
+	}
+	go u.run()
+	return u
+}
+
+// queue an event without blocking, the oldest event is dropped when the queue is full
+func (u *Uplink) Send(seq uint64, payload []byte) {
+	ev := pendingEvent{seq: seq, payload: payload}
+	// counted before it is queued so Flush never sees it missing
+	u.lock.Lock()
+	u.unsent++
+	ev.backlog = u.outage
+	u.lock.Unlock()
+	for {
+		select {
+		case u.queue <- ev:
+			return
+		default:
+		}
+		select {
+		case old := <-u.queue:
+			u.lock.Lock()
+			u.dropped++
+			u.missed++
+			u.unsent--
+			u.addDropped(old.seq)
+			u.lock.Unlock()
+		default:
+		}
+	}
+}
+
+// caller holds the lock
+func (u *Uplink) addDropped(seq uint64) {
+	if n := len(u.ranges); n > 0 && u.ranges[n-1].last+1 == seq {
+		u.ranges[n-1].last = seq
+		return
+	}
+	u.ranges = append(u.ranges, seqRange{seq, seq})
+	if len(u.ranges) > maxDroppedRanges {
+		u.ranges = u.ranges[1:]
+	}
+}
+
+// delivery report of this logger, e.g.
+// "host:1234 connected, sent 120 (5 delayed), pending 0, missed 30 [seq 41-70]"
+func (u *Uplink) Report() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	state := "disconnected"
+	if u.connected {
+		state = "connected"
+	}
+	report := fmt.Sprintf("%s %s, sent %d (%d delayed), pending %d, missed %d",
+		u.address, state, u.sent, u.delayed, len(u.queue), u.missed)
+	if len(u.ranges) > 0 {
+		parts := make([]string, len(u.ranges))
+		for i, r := range u.ranges {
+			parts[i] = strconv.FormatUint(r.first, 10)
+			if r.last != r.first {
+				parts[i] += "-" + strconv.FormatUint(r.last, 10)
+			}
+		}
+		report += " [seq " + strings.Join(parts, ",") + "]"
+	}
+	return report
+}
+
+// wait up to timeout until everything queued has been written
+func (u *Uplink) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		u.lock.Lock()
+		idle := u.unsent == 0
+		u.lock.Unlock()
+		if idle {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// close the connection so the logger sees a clean disconnect
+func (u *Uplink) Close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
+
+// dial until the logger accepts us and the connect message is out
+func (u *Uplink) dial() (net.Conn, time.Time) {
+	backoff := minBackoff
+	for {
+		var conn net.Conn
+		var err error
+		if u.tls != nil {
+			conn, err = tls.Dial("tcp", u.address, u.tls)
+		} else {
+			conn, err = net.Dial(u.network, u.address)
+		}
+		if err == nil {
+			_, err = writeFrame(conn, typeConnect, []byte(timestampNow()+" - "+u.node+" connected"))
+			if err == nil {
+				log.Println("Connection Successfully", u.address)
+				return conn, time.Now()
+			}
+			conn.Close()
+		}
+
+		log.Println("Connection Failed", u.address, err, "- retrying in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (u *Uplink) write(conn net.Conn, frameType byte, payload []byte) (int, error) {
+	u.writeLock.Lock()
+	defer u.writeLock.Unlock()
+	return writeFrame(conn, frameType, payload)
+}
+
+// reply to the logger's clock sync requests with our own clock, until the connection goes away
+func (u *Uplink) answerSync(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		frame, _, err := readFrame(r)
+		if err != nil && u.network == "udp" && !errors.Is(err, net.ErrClosed) {
+			// icmp port unreachable while the logger is down, udp has no connection to lose
+			r.Reset(conn)
+			time.Sleep(minBackoff)
+			continue
+		}
+		if err != nil {
+			// wake up the writer so it reconnects
+			conn.Close()
+			return
+		}
+		if frame.Type != typeSyncRequest {
+			continue
+		}
+		now := strconv.FormatInt(time.Now().UnixNano(), 10)
+		u.write(conn, typeSyncReply, []byte(string(frame.Payload)+" "+now))
+	}
+}
+
+func (u *Uplink) run() {
+	var pending []pendingEvent // events whose write failed, resent first after reconnecting
+	for {
+		conn, since := u.dial()
+		go u.answerSync(conn)
+		hello := since
+
+		u.lock.Lock()
+		u.conn = conn
+		u.connected = true
+		u.outage = false
+		if u.dropped > 0 {
+			log.Println(u.dropped, "events for", u.address, "dropped while disconnected")
+			u.dropped = 0
+		}
+		u.lock.Unlock()
+
+		for {
+			if len(pending) == 0 {
+				pending = u.collect()
+			}
+
+			if u.network == "udp" && time.Since(hello) > udpHelloInterval {
+				u.write(conn, typeConnect, []byte(timestampNow()+" - "+u.node+" connected"))
+				hello = time.Now()
+			}
+			delayed, err := u.writeEvents(conn, pending)
+			if err != nil && u.network == "udp" {
+				// nobody listening right now, the datagram is gone and the logger will see the gap
+				u.lock.Lock()
+				for _, ev := range pending {
+					u.missed++
+					u.addDropped(ev.seq)
+				}
+				u.unsent -= len(pending)
+				u.lock.Unlock()
+				pending = nil
+				continue
+			}
+			if err != nil {
+				log.Println("Lost connection to logger", u.address, err)
+				conn.Close()
+				u.lock.Lock()
+				u.conn = nil
+				u.connected = false
+				u.outage = true
+				u.lock.Unlock()
+				for i := range pending {
+					pending[i].backlog = true // resent after the reconnect, late like the rest
+				}
+				break
+			}
+
+			u.lock.Lock()
+			u.unsent -= len(pending)
+			u.sent += len(pending)
+			u.delayed += delayed
+			u.lock.Unlock()
+			pending = nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// interval between heartbeats to every connected node
+var heartbeatInterval = 1 * time.Second
+
+// a node that has not been heard from for this long is declared failed
+var suspectTimeout = 5 * time.Second
+
+// every node waits this long after listening before it dials the others
+const startupDelay = 10 * time.Second
+
+// a change of the group the ISIS ordering waits on
+type MembershipChange struct {
+	Node   string
+	Failed bool // only failures for now, nodes never (re)join after startup
+	Reason string
+}
+
+// membership changes for the ordering logic, see ConsumeMembership
+var MembershipChanges = make(chan MembershipChange, 64)
+
+// heartbeat failure detector: any message from a node counts as a sign of life
+type FailureDetector struct {
+	lock      sync.Mutex
+	lastHeard map[string]time.Time
+	failed    map[string]bool
+}
+
+var Detector = FailureDetector{
+	lastHeard: make(map[string]time.Time),
+	failed:    make(map[string]bool),
+}
+
+// start watching a node, it has grace plus suspectTimeout to send its first message
+func (d *FailureDetector) Watch(id string, grace time.Duration) {
+	d.lock.Lock()
+	d.lastHeard[id] = time.Now().Add(grace)
+	d.lock.Unlock()
+}
+
+// record a message from a node
+func (d *FailureDetector) Heard(id string) {
+	d.lock.Lock()
+	if _, ok := d.lastHeard[id]; ok {
+		d.lastHeard[id] = time.Now()
+	}
+	d.lock.Unlock()
+}
+
+func (d *FailureDetector) Failed(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.failed[id]
+}
+
+// every node declared failed so far
+func (d *FailureDetector) FailedNodes() map[string]bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	failed := make(map[string]bool, len(d.failed))
+	for id := range d.failed {
+		failed[id] = true
+	}
+	return failed
+}
+
+// declare a node failed: drop it from the group and tell the ordering logic, once per node
+func (d *FailureDetector) Fail(id string, reason string) {
+	d.lock.Lock()
+	if d.failed[id] {
+		d.lock.Unlock()
+		return
+	}
+	if _, ok := d.lastHeard[id]; !ok {
+		d.lock.Unlock()
+		return
+	}
+	d.failed[id] = true
+	delete(d.lastHeard, id)
+	d.lock.Unlock()
+
+	NodeLock.Lock()
+	if node, ok := ConnectedNodes[id]; ok {
+		node.Connection.Close()
+		delete(ConnectedNodes, id)
+	}
+	nodeNum--
+	NodeLock.Unlock()
+
+	fmt.Println("Node", id, "failed:", reason)
+	MembershipChanges <- MembershipChange{Node: id, Failed: true, Reason: reason}
+}
+
+// send heartbeats and suspect nodes that went quiet
+func (d *FailureDetector) Run() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		Multicast("", "HB", "")
+		for _, id := range d.Quiet(time.Now()) {
+			d.Fail(id, "no heartbeat for "+suspectTimeout.String())
+		}
+	}
+}
+
+// watched nodes not heard from for longer than suspectTimeout at now
+func (d *FailureDetector) Quiet(now time.Time) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var quiet []string
+	for id, heard := range d.lastHeard {
+		if now.Sub(heard) > suspectTimeout {
+			quiet = append(quiet, id)
+		}
+	}
+	return quiet
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+)
+
+// bumped whenever the messages between nodes change incompatibly
+const protocolVersion = 1
+
+// nodes only talk to nodes of the same cluster, set with -cluster
+var clusterId = "mp1"
+
+// nodes with an accepted incoming connection, guarded by NodeLock
+var IncomingNodes = make(map[string]bool)
+
+// first message on every connection we dial
+func sendHello(conn net.Conn) error {
+	return json.NewEncoder(conn).Encode(MsgJson{MsgType: "HELLO", Sender: hostNode.Id, Version: protocolVersion, Cluster: clusterId})
+}
+
+// the dialing side only ever hears back from a node that rejects it. the
+// connection is closed and, since nothing arrives from that node either,
+// the failure detector takes it out of the group
+func watchRejection(conn net.Conn, id string) {
+	var msgJson MsgJson
+	if err := json.NewDecoder(conn).Decode(&msgJson); err != nil {
+		return
+	}
+	if msgJson.MsgType == "REJECT" {
+		log.Println("Rejected by", id+":", msgJson.Content)
+		conn.Close()
+	}
+}
+
+// check the hello of an incoming connection and claim its node id,
+// returns the reason when the connection has to be rejected
+func acceptHello(hello MsgJson) string {
+	if hello.MsgType != "HELLO" {
+		return "expected HELLO, got " + strconv.Quote(hello.MsgType)
+	}
+	if hello.Version != protocolVersion {
+		return "protocol version " + strconv.Itoa(hello.Version) + ", expected " + strconv.Itoa(protocolVersion)
+	}
+	if hello.Cluster != clusterId {
+		return "cluster " + strconv.Quote(hello.Cluster) + ", expected " + strconv.Quote(clusterId)
+	}
+	if _, ok := NodeRanks[hello.Sender]; !ok {
+		return "unknown node " + strconv.Quote(hello.Sender)
+	}
+	if hello.Sender == hostNode.Id {
+		return "duplicate node " + hello.Sender + ", that is us"
+	}
+	if Detector.Failed(hello.Sender) {
+		return "node " + hello.Sender + " was declared failed"
+	}
+
+	NodeLock.Lock()
+	defer NodeLock.Unlock()
+	if IncomingNodes[hello.Sender] {
+		return "duplicate node " + hello.Sender + ", already connected"
+	}
+	IncomingNodes[hello.Sender] = true
+	return ""
+}
+
+// release the node id of an incoming connection that went away
+func releaseHello(id string) {
+	NodeLock.Lock()
+	delete(IncomingNodes, id)
+	NodeLock.Unlock()
+}
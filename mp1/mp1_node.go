@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"container/heap"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -19,8 +20,9 @@ type Transaction struct {
 	TransactionId     string // ID of a transaction
 	DeliverStatus bool   // true-delivered, false-not delivered
 	Priority      int
-	Sender        int    // which node sends the message
+	Sender        int    // node that proposed Priority, breaks ties
 	Content   string // content of transaction
+	Origin    string // node that multicast the transaction
 }
 
 type Node struct {
@@ -33,6 +35,7 @@ type Node struct {
 type SequenceObject struct {
 	Sender   int
 	Priority int
+	Node     string // id of the proposing node
 }
 
 // msg json format
@@ -41,6 +44,9 @@ type MsgJson struct {
 	Sender    string `json:"sender"`
 	TransactionId string `json:"id"`
 	Content   string `json:"content"`
+	MsgId     string `json:"msgId,omitempty"` // set on R-multicast messages, see Reforward
+	Version   int    `json:"version,omitempty"` // HELLO only
+	Cluster   string `json:"cluster,omitempty"` // HELLO only
 }
 
 // bank accounts with balance
@@ -58,8 +64,11 @@ var Accounts Account
 // a list of node id to dns address/port mapping
 var NodesToPorts map[string]Node 
 
-// a list of ip address to node id mapping
-var AddressToId map[string]string
+// node ids in config order, a node's rank is its position + 1
+var NodeIds []string
+
+// node id to rank, ranks break ISIS priority ties
+var NodeRanks map[string]int
 
 // a list of actually joined nodes
 var ConnectedNodes map[string]Node 
@@ -95,11 +104,28 @@ type PriorityQueue []Transaction
 func (pq PriorityQueue) Len() int {
 	return len(pq)
 }
-func (pq PriorityQueue) Less(i, j int) bool {
-	if pq[i].Priority == pq[j].Priority { // break ties
-		return pq[i].Sender > pq[j].Sender
+// ISIS order of (priority, proposer rank) pairs, agreement and delivery must both use it
+func deliveredBefore(priority int, sender int, otherPriority int, otherSender int) bool {
+	if priority == otherPriority { // break ties
+		return sender < otherSender
+	}
+	return priority < otherPriority
+}
+
+// the proposal that is delivered last, it becomes the agreed priority
+func maxProposal(proposals []SequenceObject) SequenceObject {
+	best := proposals[0]
+	for _, proposal := range proposals[1:] {
+		if deliveredBefore(best.Priority, best.Sender, proposal.Priority, proposal.Sender) {
+			best = proposal
+		}
 	}
-	return pq[i].Priority > pq[j].Priority
+	return best
+}
+
+// smallest priority at the head, the transaction delivered next
+func (pq PriorityQueue) Less(i, j int) bool {
+	return deliveredBefore(pq[i].Priority, pq[i].Sender, pq[j].Priority, pq[j].Sender)
 }
 func (pq PriorityQueue) Swap(i, j int) {
 	pq[i], pq[j] = pq[j], pq[i]
@@ -114,32 +140,33 @@ func (pq *PriorityQueue) Pop() interface{} {
 func (pq *PriorityQueue) Push(x interface{}) {
 	*pq = append(*pq, x.(Transaction))
 }
-func (pq *PriorityQueue) Update(transactionId string, priority int, sender int, msgType string) {
+// set the agreed priority, returns the transaction's originator or false if it is not queued
+func (pq *PriorityQueue) Update(transactionId string, priority int, sender int) (string, bool) {
 	for i := range *pq {
 		if (*pq)[i].DeliverStatus == false && (*pq)[i].TransactionId == transactionId {
 	  		(*pq)[i].Priority = priority
 	  		(*pq)[i].DeliverStatus = true
 	  		(*pq)[i].Sender = sender
+	  		origin := (*pq)[i].Origin
 	  		heap.Fix(pq, i)
-	  		return
+	  		return origin, true
 	 	}
 	}
+	return "", false
 }
    
 func(pq *PriorityQueue) Top() interface{} {
 	old := *pq
-	n := len(old)
-	if n == 0{
+	if len(old) == 0{
 		return nil
 	}
-	x := old[n-1]
-	return x
+	return old[0]
 }
 
 func ReadFile(path string) {
 
 	NodesToPorts = make(map[string]Node)
-	AddressToId = make(map[string]string)
+	NodeRanks = make(map[string]int)
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -157,22 +184,38 @@ func ReadFile(path string) {
 
 	for d := 0; d < nodeNum; d++ {
 		line, _ := buf.ReadString('\n')
-		nodeInfo := strings.Split(line, " ")
-		address, _ := net.LookupHost(strings.TrimSpace(nodeInfo[1]))
+		// "<node id> <host> <port>", the id can be any string without spaces
+		nodeInfo := strings.Fields(line)
+		if len(nodeInfo) != 3 {
+			log.Fatal("Config file structure is incorrect")
+		}
+		if _, ok := NodeRanks[nodeInfo[0]]; ok {
+			log.Fatal("Node ", nodeInfo[0], " appears twice in the config file")
+		}
+		address, err := net.LookupHost(nodeInfo[1])
+		if err != nil {
+			log.Fatal("Cannot resolve ", nodeInfo[1], ": ", err)
+		}
 		
 		node := Node {
-			Id: strings.TrimSpace(nodeInfo[0]),
+			Id: nodeInfo[0],
 			Address: address[0], 
-			Port: strings.TrimSpace(nodeInfo[2]),
+			Port: nodeInfo[2],
 		}
 		NodesToPorts[node.Id] = node
-		AddressToId[address[0]] = strings.TrimSpace(nodeInfo[0])
-		if node.Id == os.Args[1] {
+		NodeIds = append(NodeIds, node.Id)
+		NodeRanks[node.Id] = d + 1
+		if node.Id == flag.Arg(0) {
 			hostNode = node
 		}
 	}
 }
 
+// rank of a node for ISIS tie-breaking, its position in the config file
+func rankOf(id string) int {
+	return NodeRanks[id]
+}
+
 func ProcessTransaction(transaction Transaction) {
 	content := transaction.Content
 	transInfo := strings.Split(content, " ")
@@ -222,6 +265,8 @@ func ProcessTransaction(transaction Transaction) {
 
 // deliver a transaction from the front of pq
 func ProcessPQ(){
+	PQLock.Lock()
+	defer PQLock.Unlock()
 	for {
 		t := pq.Top()
 		if t == nil {
@@ -231,48 +276,87 @@ func ProcessPQ(){
 	 	if top.DeliverStatus == false {
 			break
 		}
-		msg, _ := pq.Pop().(Transaction)
+		msg, _ := heap.Pop(&pq).(Transaction)
 		ProcessTransaction(msg)
 	}
 }
    
-func receiveMsg(conn net.Conn, id string) {
+func receiveMsg(conn net.Conn) {
 	defer conn.Close()
 
+	// one decoder for the connection, it buffers ahead
+	decoder := json.NewDecoder(conn)
+
+	// the dialing node says who it is before anything else
+	conn.SetReadDeadline(time.Now().Add(suspectTimeout))
+	var hello MsgJson
+	if err := decoder.Decode(&hello); err != nil {
+		log.Println("No hello from", conn.RemoteAddr(), err)
+		return
+	}
+	if reason := acceptHello(hello); reason != "" {
+		log.Println("Rejected connection from", conn.RemoteAddr(), "claiming to be", hello.Sender+":", reason)
+		json.NewEncoder(conn).Encode(MsgJson{MsgType: "REJECT", Sender: hostNode.Id, Content: reason})
+		return
+	}
+	id := hello.Sender
+	defer releaseHello(id)
+	// the hello is the first sign of life, silence counts from here
+	Detector.Watch(id, 0)
+
 	for {
-		// deadline := time.Now().Add(5 * time.Second)
-    	// conn.SetDeadline(deadline)
+		// heartbeats keep a live node's connection busy, silence means it failed
+		conn.SetReadDeadline(time.Now().Add(suspectTimeout))
 		var msgJson MsgJson
-		err := json.NewDecoder(conn).Decode(&msgJson)
+		err := decoder.Decode(&msgJson)
 		if err != nil {
-
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout(){
-				NodeLock.Lock()
-				delete(ConnectedNodes, id)
-				nodeNum--
-				NodeLock.Unlock()
-				return
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				Detector.Fail(id, "no message for "+suspectTimeout.String())
+			} else {
+				Detector.Fail(id, "connection lost: "+err.Error())
 			}
-			continue
+			return
 		}
 
-		deadline := time.Now().Add(10 * time.Second)
-    	conn.SetDeadline(deadline)
+		Detector.Heard(id)
+
+		// R-deliver: forward a multicast message before handling it, ignore copies
+		if msgJson.MsgId != "" {
+			if !Seen.FirstTime(msgJson.MsgId) {
+				continue
+			}
+			Reforward(msgJson, id)
+		}
 
 		content := msgJson.Content
 		msgType := msgJson.MsgType
 		transactionId := msgJson.TransactionId
-		sender, _ := strconv.Atoi(string(msgJson.Sender[4]))
+		sender := rankOf(msgJson.Sender)
 
-		if msgType == "T" {
+		if msgType == "HB" {
+			continue
+		} else if msgType == "T" {
 			// received message strcture: <transaction content, "T", transaction id, sender>
+			// until the agreement arrives the transaction sits at our own proposal
+			PQLock.Lock()
+			if Discarded[transactionId] {
+				// its originator failed and the survivors dropped it
+				PQLock.Unlock()
+				continue
+			}
 			proposedPriority := currentPriority
 			currentPriority++
-			transaction := Transaction{transactionId, false, proposedPriority, sender, content}
-
-			PQLock.Lock()
-			pq.Push(transaction)
+			transaction := Transaction{transactionId, false, proposedPriority, rankOf(hostNode.Id), content, msgJson.Sender}
+			if agreed, ok := EarlyAgreements[transactionId]; ok {
+				delete(EarlyAgreements, transactionId)
+				transaction.Priority, transaction.Sender, transaction.DeliverStatus = agreed.Priority, agreed.Sender, true
+				Finalized[transactionId] = msgJson.Sender
+			}
+			heap.Push(&pq, transaction)
 			PQLock.Unlock()
+			if transaction.DeliverStatus {
+				ProcessPQ()
+			}
 
 			// sent message structure: <proposed priority, "PP", transaction id>
 			go sendMsg(strconv.Itoa(proposedPriority), "PP", transactionId, msgJson.Sender)
@@ -282,25 +366,12 @@ func receiveMsg(conn net.Conn, id string) {
 			proposedPriority, _ := strconv.Atoi(content)
 
 			SequenceLock.Lock()
-			SequenceOrdering[transactionId] = append(SequenceOrdering[transactionId], SequenceObject{sender, proposedPriority})
+			if _, ok := SequenceOrdering[transactionId]; ok {
+				SequenceOrdering[transactionId] = append(SequenceOrdering[transactionId], SequenceObject{sender, proposedPriority, msgJson.Sender})
+			}
 			SequenceLock.Unlock()
 
-			maxPriority := 0
-			var maxPrioritySender int
-			SequenceLock.RLock()
-			if len(SequenceOrdering[transactionId]) == nodeNum {
-				for n := 0; n < nodeNum; n++ {
-					if maxPriority < SequenceOrdering[transactionId][n].Priority {
-						maxPriority = SequenceOrdering[transactionId][n].Priority
-						maxPrioritySender = SequenceOrdering[transactionId][n].Sender
-					}
-				}
-				pq.Update(transactionId, maxPriority, maxPrioritySender, msgType)
-				// sent message structure: <agreed priority | agreed priority sender, "PA", transaction id>
-				go sendMsg(strconv.Itoa(maxPriority)+"|"+strconv.Itoa(maxPrioritySender), "PA", transactionId, msgJson.Sender)
-				ProcessPQ()
-			}
-			SequenceLock.RUnlock()
+			TryAgree(transactionId)
 
 		} else if msgType == "PA" {
 			// received message structure: <agreed priority | agreed priority sender, "PA", transaction id, sender>
@@ -308,17 +379,94 @@ func receiveMsg(conn net.Conn, id string) {
 			maxPriority, _ := strconv.Atoi(agreedPriorityInfo[0])
 			maxPrioritySender, _ := strconv.Atoi(agreedPriorityInfo[1])
 
-			PQLock.Lock()
-			pq.Update(transactionId, maxPriority, maxPrioritySender, msgType)
-			PQLock.Unlock()
+			ApplyAgreement(transactionId, maxPriority, maxPrioritySender)
 
 			// process transaction
 			ProcessPQ()
+
+		} else if msgType == "DT" {
+			// the coordinator dropped a transaction of a failed node
+			Discard(transactionId)
+			ProcessPQ()
+
+		} else if msgType == "OR" {
+			// a survivor's report on a failed node's transactions, we are the coordinator
+			var report orphanReport
+			if err := json.Unmarshal([]byte(content), &report); err == nil {
+				Orphans.Receive(transactionId, msgJson.Sender, report)
+			}
+
+		} else if msgType == "OD" {
+			// the coordinator decided on every transaction of the failed node
+			Orphans.Resolved(transactionId)
+		}
+	}
+}
+
+// agree on the priority of one of our transactions once every live node has proposed one
+func TryAgree(transactionId string) {
+	SequenceLock.Lock()
+	proposals, ok := SequenceOrdering[transactionId]
+	if !ok {
+		SequenceLock.Unlock()
+		return
+	}
+	proposed := make(map[string]bool)
+	for _, proposal := range proposals {
+		proposed[proposal.Node] = true
+	}
+	NodeLock.RLock()
+	for id := range ConnectedNodes {
+		if !proposed[id] {
+			// still waiting for this node
+			NodeLock.RUnlock()
+			SequenceLock.Unlock()
+			return
 		}
 	}
+	NodeLock.RUnlock()
+
+	agreed := maxProposal(proposals)
+	maxPriority, maxPrioritySender := agreed.Priority, agreed.Sender
+	delete(SequenceOrdering, transactionId)
+	SequenceLock.Unlock()
+
+	ApplyAgreement(transactionId, maxPriority, maxPrioritySender)
+	// sent message structure: <agreed priority | agreed priority sender, "PA", transaction id>
+	go sendMsg(strconv.Itoa(maxPriority)+"|"+strconv.Itoa(maxPrioritySender), "PA", transactionId, hostNode.Id)
+	ProcessPQ()
+}
+
+// stop waiting for proposals from nodes the failure detector declared failed
+func ConsumeMembership() {
+	for change := range MembershipChanges {
+		if !change.Failed {
+			continue
+		}
+		SequenceLock.RLock()
+		pending := make([]string, 0, len(SequenceOrdering))
+		for transactionId := range SequenceOrdering {
+			pending = append(pending, transactionId)
+		}
+		SequenceLock.RUnlock()
+
+		for _, transactionId := range pending {
+			TryAgree(transactionId)
+		}
+
+		// transactions the failed node started but never agreed on
+		Orphans.Report()
+	}
 }
 
 func Multicast(msg string, msgType string, transactionId string) {
+	msgJson := MsgJson{Content: msg, MsgType: msgType, TransactionId: transactionId, Sender: hostNode.Id}
+	if msgType != "HB" {
+		// receivers re-forward it, so it gets everywhere even if we fail halfway through the loop
+		msgJson.MsgId = messageId(msgJson)
+		Seen.FirstTime(msgJson.MsgId)
+	}
+
 	NodeLock.RLock()
 	for key, _ := range ConnectedNodes {
 		if key != hostNode.Id {	
@@ -327,7 +475,6 @@ func Multicast(msg string, msgType string, transactionId string) {
 				conn := ConnectedNodes[key].Connection
 
 				// json the msg
-				msgJson := MsgJson{Content: msg, MsgType: msgType, TransactionId: transactionId, Sender: hostNode.Id}
 				json.NewEncoder(conn).Encode(msgJson)
 				// if err != nil {
 				// 	fmt.Println("Error encoding JSON:", err)
@@ -355,20 +502,25 @@ func Unicast(msg string, msgType string, transactionId string, targetId string){
 func sendMsg(msg string, msgType string, transactionId string, targetId string) {
 	if msgType == "T" {
 		// create the transaction and store it into pq
-		sender, _ := strconv.Atoi(string(hostNode.Id[4]))
+		sender := rankOf(hostNode.Id)
+		PQLock.Lock()
 		proposedPriority := currentPriority
 		currentPriority++
-		transaction := Transaction{transactionId, false, proposedPriority, sender, msg}
-		SequenceOrdering[transactionId] = append(SequenceOrdering[transactionId], SequenceObject{sender, proposedPriority})
-
-		PQLock.Lock()
-		pq.Push(transaction)
+		transaction := Transaction{transactionId, false, proposedPriority, sender, msg, hostNode.Id}
+		heap.Push(&pq, transaction)
 		PQLock.Unlock()
 
+		SequenceLock.Lock()
+		SequenceOrdering[transactionId] = append(SequenceOrdering[transactionId], SequenceObject{sender, proposedPriority, hostNode.Id})
+		SequenceLock.Unlock()
+
 		// multicast the new transaction to other nodes
 		// <transaction content, "T", transaction id>
 		Multicast(msg, msgType, transactionId)
 
+		// nothing to wait for when every other node has failed
+		TryAgree(transactionId)
+
 	} else if msgType == "PP" {
 		// multicast the proposed priority to other nodes
 		// <proposed priority, "PP", transaction id, >
@@ -424,8 +576,8 @@ func initialize() {
 		account: make(map[string]int),
 	}
 	SequenceOrdering = make(map[string][]SequenceObject)
-	pq := &PriorityQueue{}
-	heap.Init(pq)
+	pq = PriorityQueue{}
+	heap.Init(&pq)
 
 	NodeLock = sync.RWMutex{}
 	PQLock = sync.RWMutex{}
@@ -435,13 +587,21 @@ func initialize() {
 }
 
 func main() {
-	if len(os.Args) > 1 {
-		configFilePath = os.Args[2]
+	flag.DurationVar(&heartbeatInterval, "heartbeat", heartbeatInterval, "interval between heartbeats to the other nodes")
+	flag.StringVar(&clusterId, "cluster", clusterId, "cluster id, connections from other clusters are rejected")
+	flag.DurationVar(&suspectTimeout, "suspect", suspectTimeout, "silence after which a node is declared failed")
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		configFilePath = flag.Arg(1)
 	} else {
 		log.Println("Please enter the node number and config file in the command line")
 	}
 
 	ReadFile(configFilePath)
+	if hostNode.Id == "" {
+		log.Fatal("Node ", flag.Arg(0), " is not in ", configFilePath)
+	}
 
 	// listen on port
 	listener, _ := net.Listen("tcp", ":" + hostNode.Port)
@@ -453,14 +613,13 @@ func main() {
 
 	fmt.Println("Please wait for around 10 seconds for all the nodes to be connected")
 
-	time.Sleep(10e9)
+	time.Sleep(startupDelay)
 
 	initialize()
 
 	for len(ConnectedNodes) < (nodeNum - 1) {
-		for i := 1; i <= nodeNum; i++ {
-			nodeId := "node" + strconv.Itoa(i)
-			if nodeId == hostNode.Id {
+		for _, nodeId := range NodeIds {
+			if nodeId == hostNode.Id || ConnectedNodes[nodeId].Connection != nil {
 				continue
 			}
 			nodeInfo := NodesToPorts[nodeId]
@@ -470,6 +629,11 @@ func main() {
 				// fmt.Println("err ", err)
 				continue
 			}
+			if err := sendHello(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			go watchRejection(conn, nodeId)
 	
 			node := Node {
 				Id: nodeId,
@@ -485,6 +649,16 @@ func main() {
 
 	// time.Sleep(10e9)
 
+	// watch every node we are connected to. a node that started later than us is
+	// still sleeping before it dials back, its hello restarts the clock in receiveMsg
+	NodeLock.RLock()
+	for nodeId := range ConnectedNodes {
+		Detector.Watch(nodeId, startupDelay)
+	}
+	NodeLock.RUnlock()
+	go Detector.Run()
+	go ConsumeMembership()
+
 	// send a new transaction
 	go sendTransaction()
 
@@ -498,14 +672,7 @@ func main() {
 			return
 		}
 
-		ip := conn.RemoteAddr().String()
-		
-		ipAddress := strings.Split(ip, ":")
-
-		nodeId := AddressToId[ipAddress[0]]
-		node := ConnectedNodes[nodeId]
-
-		// go CheckConnection(&node)
-		go receiveMsg(conn, node.Id)
+		// the hello on the connection says which node it is
+		go receiveMsg(conn)
 	}
 }
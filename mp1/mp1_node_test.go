@@ -0,0 +1,70 @@
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// the agreed priority of a transaction must be the proposal the queue delivers last,
+// otherwise a node can deliver another transaction between tied proposals
+func TestAgreementMatchesQueueOrder(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for round := 0; round < 1000; round++ {
+		proposals := make([]SequenceObject, 1+random.Intn(5))
+		for i := range proposals {
+			// few distinct priorities so ties are common
+			proposals[i] = SequenceObject{Sender: 1 + random.Intn(9), Priority: random.Intn(3)}
+		}
+		agreed := maxProposal(proposals)
+
+		var queue PriorityQueue
+		for i, p := range proposals {
+			heap.Push(&queue, Transaction{TransactionId: string(rune('a' + i)), Priority: p.Priority, Sender: p.Sender})
+		}
+		var last Transaction
+		for queue.Len() > 0 {
+			last = heap.Pop(&queue).(Transaction)
+		}
+		if last.Priority != agreed.Priority || last.Sender != agreed.Sender {
+			t.Fatalf("proposals %v: agreed (%d, %d) but the queue delivers (%d, %d) last",
+				proposals, agreed.Priority, agreed.Sender, last.Priority, last.Sender)
+		}
+	}
+}
+
+func TestDeliveredBeforeBreaksTiesByRank(t *testing.T) {
+	if !deliveredBefore(3, 1, 3, 2) || deliveredBefore(3, 2, 3, 1) {
+		t.Fatal("equal priorities must be ordered by proposer rank")
+	}
+	if !deliveredBefore(2, 9, 3, 1) {
+		t.Fatal("a smaller priority must come first regardless of rank")
+	}
+}
+
+// a node started a few seconds after us sleeps startupDelay before its hello,
+// it must not be suspected before then, but silence after the hello is
+func TestStaggeredStartIsNotSuspected(t *testing.T) {
+	d := FailureDetector{lastHeard: make(map[string]time.Time), failed: make(map[string]bool)}
+	start := time.Now()
+	d.Watch("late", startupDelay)
+
+	if quiet := d.Quiet(start.Add(startupDelay)); len(quiet) != 0 {
+		t.Fatalf("suspected %v before it could say hello", quiet)
+	}
+	if quiet := d.Quiet(start.Add(startupDelay + suspectTimeout + time.Second)); len(quiet) != 1 {
+		t.Fatalf("a node that never says hello must be suspected eventually, got %v", quiet)
+	}
+
+	// the hello arrives
+	d.Watch("late", 0)
+	hello := time.Now()
+	if quiet := d.Quiet(hello.Add(suspectTimeout - time.Second)); len(quiet) != 0 {
+		t.Fatalf("suspected %v right after its hello", quiet)
+	}
+	d.Heard("late")
+	if quiet := d.Quiet(time.Now().Add(suspectTimeout + time.Second)); len(quiet) != 1 {
+		t.Fatalf("a node silent after its hello must be suspected, got %v", quiet)
+	}
+}
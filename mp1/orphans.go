@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// transactions whose originator failed before sending "PA" would block the
+// head of pq forever. the surviving node with the lowest rank coordinates:
+// every survivor reports what it holds of the failed node's transactions, then
+// the coordinator finalizes those every survivor has with the highest proposal
+// and discards the rest, both through R-multicast so all survivors agree
+
+// an agreed priority, possibly for a transaction whose "T" has not arrived yet
+type agreement struct {
+	Priority int
+	Sender   int
+}
+
+// pq side state, guarded by PQLock
+var (
+	// "PA" that arrived before its "T" (forwarded copies can overtake each other)
+	EarlyAgreements = make(map[string]agreement)
+	// transaction id -> originator of every transaction with an agreed priority
+	Finalized = make(map[string]string)
+	// transactions dropped because their originator failed, a late "T" is ignored
+	Discarded = make(map[string]bool)
+)
+
+// apply an agreed priority, returns false if the transaction was discarded already
+func ApplyAgreement(transactionId string, priority int, sender int) bool {
+	PQLock.Lock()
+	defer PQLock.Unlock()
+	if Discarded[transactionId] {
+		return false
+	}
+	if origin, ok := pq.Update(transactionId, priority, sender); ok {
+		Finalized[transactionId] = origin
+	} else if _, done := Finalized[transactionId]; !done {
+		EarlyAgreements[transactionId] = agreement{priority, sender}
+	}
+	// never propose below a priority that was agreed on
+	if priority >= currentPriority {
+		currentPriority = priority + 1
+	}
+	return true
+}
+
+// drop an undelivered transaction everywhere it is queued
+func Discard(transactionId string) {
+	PQLock.Lock()
+	defer PQLock.Unlock()
+	Discarded[transactionId] = true
+	delete(EarlyAgreements, transactionId)
+	for i := range pq {
+		if pq[i].TransactionId == transactionId && !pq[i].DeliverStatus {
+			heap.Remove(&pq, i)
+			return
+		}
+	}
+}
+
+// what one survivor holds of a failed node's transactions
+type orphanReport struct {
+	Pending []orphanEntry // queued without an agreed priority
+	Final   []string      // agreed on, delivered or not
+}
+
+type orphanEntry struct {
+	TransactionId string
+	Priority      int // our proposal
+	Sender        int
+}
+
+func collectOrphans(failed string) orphanReport {
+	PQLock.RLock()
+	defer PQLock.RUnlock()
+	report := orphanReport{Pending: []orphanEntry{}, Final: []string{}}
+	for _, t := range pq {
+		if t.Origin == failed && !t.DeliverStatus {
+			report.Pending = append(report.Pending, orphanEntry{t.TransactionId, t.Priority, t.Sender})
+		}
+	}
+	for transactionId, origin := range Finalized {
+		if origin == failed {
+			report.Final = append(report.Final, transactionId)
+		}
+	}
+	return report
+}
+
+// reports collected by the coordinator, per failed node and reporter
+type orphanRound struct {
+	lock     sync.Mutex
+	reports  map[string]map[string]orphanReport
+	resolved map[string]bool // failed nodes whose orphans have been decided
+}
+
+var Orphans = orphanRound{
+	reports:  make(map[string]map[string]orphanReport),
+	resolved: make(map[string]bool),
+}
+
+// live node with the lowest rank
+func coordinator() string {
+	NodeLock.RLock()
+	defer NodeLock.RUnlock()
+	lowest := hostNode.Id
+	for id := range ConnectedNodes {
+		if rankOf(id) < rankOf(lowest) {
+			lowest = id
+		}
+	}
+	return lowest
+}
+
+// send our report on every unresolved failed node to the current coordinator,
+// again after every membership change in case the coordinator itself failed
+func (o *orphanRound) Report() {
+	o.lock.Lock()
+	var failed []string
+	for id := range Detector.FailedNodes() {
+		if !o.resolved[id] {
+			failed = append(failed, id)
+		}
+	}
+	o.lock.Unlock()
+
+	target := coordinator()
+	for _, id := range failed {
+		report := collectOrphans(id)
+		if target == hostNode.Id {
+			o.Receive(id, hostNode.Id, report)
+			continue
+		}
+		content, _ := json.Marshal(report)
+		Unicast(string(content), "OR", id, target)
+	}
+	if target == hostNode.Id {
+		o.DecideAll()
+	}
+}
+
+// a survivor's report, received by the coordinator
+func (o *orphanRound) Receive(failed string, reporter string, report orphanReport) {
+	o.lock.Lock()
+	if o.reports[failed] == nil {
+		o.reports[failed] = make(map[string]orphanReport)
+	}
+	o.reports[failed][reporter] = report
+	o.lock.Unlock()
+	o.Decide(failed)
+}
+
+func (o *orphanRound) DecideAll() {
+	o.lock.Lock()
+	var failed []string
+	for id := range o.reports {
+		failed = append(failed, id)
+	}
+	o.lock.Unlock()
+	for _, id := range failed {
+		o.Decide(id)
+	}
+}
+
+// once every live node reported on failed, finalize or discard each of its pending transactions
+func (o *orphanRound) Decide(failed string) {
+	if coordinator() != hostNode.Id || !Detector.Failed(failed) {
+		return
+	}
+
+	members := []string{hostNode.Id}
+	NodeLock.RLock()
+	for id := range ConnectedNodes {
+		members = append(members, id)
+	}
+	NodeLock.RUnlock()
+
+	o.lock.Lock()
+	if o.resolved[failed] {
+		o.lock.Unlock()
+		return
+	}
+	reports := o.reports[failed]
+	for _, id := range members {
+		if _, ok := reports[id]; !ok {
+			o.lock.Unlock()
+			return // still waiting for this survivor
+		}
+	}
+	o.resolved[failed] = true
+	o.lock.Unlock()
+
+	final := make(map[string]bool)
+	held := make(map[string][]orphanEntry)
+	for _, id := range members {
+		for _, transactionId := range reports[id].Final {
+			final[transactionId] = true
+		}
+		for _, entry := range reports[id].Pending {
+			held[entry.TransactionId] = append(held[entry.TransactionId], entry)
+		}
+	}
+
+	ids := make([]string, 0, len(held))
+	for transactionId := range held {
+		ids = append(ids, transactionId)
+	}
+	sort.Strings(ids)
+	finalized, discarded := 0, 0
+	for _, transactionId := range ids {
+		entries := held[transactionId]
+		if final[transactionId] {
+			// its "PA" reached a survivor, R-multicast brings it to the others
+			continue
+		}
+		if len(entries) < len(members) {
+			// not every survivor can deliver it
+			Discard(transactionId)
+			Multicast("", "DT", transactionId)
+			discarded++
+			continue
+		}
+		best := entries[0]
+		for _, entry := range entries[1:] {
+			if deliveredBefore(best.Priority, best.Sender, entry.Priority, entry.Sender) {
+				best = entry
+			}
+		}
+		ApplyAgreement(transactionId, best.Priority, best.Sender)
+		Multicast(strconv.Itoa(best.Priority)+"|"+strconv.Itoa(best.Sender), "PA", transactionId)
+		finalized++
+	}
+	Multicast("", "OD", failed)
+	fmt.Println("Orphans of", failed+":", finalized, "finalized,", discarded, "discarded")
+	ProcessPQ()
+}
+
+// the coordinator is done with failed
+func (o *orphanRound) Resolved(failed string) {
+	o.lock.Lock()
+	o.resolved[failed] = true
+	o.lock.Unlock()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// R-multicast: every node re-forwards a multicast message the first time it
+// sees it, so a message that reached one correct node reaches all of them even
+// if its originator crashed halfway through sending it
+type seenMessages struct {
+	lock sync.Mutex
+	ids  map[string]bool
+}
+
+var Seen = seenMessages{ids: make(map[string]bool)}
+
+// id of a multicast message, transaction ids are only unique per originator
+func messageId(msgJson MsgJson) string {
+	return msgJson.MsgType + ":" + msgJson.Sender + ":" + msgJson.TransactionId
+}
+
+// record a message id, returns false if it was seen before
+func (s *seenMessages) FirstTime(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ids[id] {
+		return false
+	}
+	s.ids[id] = true
+	return true
+}
+
+// pass a message on to every node except the one it came from and its originator
+func Reforward(msgJson MsgJson, from string) {
+	NodeLock.RLock()
+	defer NodeLock.RUnlock()
+	for key, node := range ConnectedNodes {
+		if key == from || key == msgJson.Sender || key == hostNode.Id {
+			continue
+		}
+		json.NewEncoder(node.Connection).Encode(msgJson)
+	}
+}